@@ -3,8 +3,10 @@ package communication
 import (
 	"context"
 	"fmt"
+	"github.com/kulycloud/common/security"
 	protoCommon "github.com/kulycloud/protocol/common"
 	"google.golang.org/grpc"
+	"io"
 )
 
 type ComponentCommunicator struct {
@@ -13,7 +15,7 @@ type ComponentCommunicator struct {
 }
 
 func NewComponentCommunicatorFromEndpoint(endpoint *protoCommon.Endpoint) (*ComponentCommunicator, error) {
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%v", endpoint.Host, endpoint.Port), grpc.WithInsecure())
+	conn, err := security.Dial(fmt.Sprintf("%s:%v", endpoint.Host, endpoint.Port), nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not create connection to component: %w", err)
 	}
@@ -30,6 +32,14 @@ func (communicator *ComponentCommunicator) Ping(ctx context.Context) error {
 	return err
 }
 
+// Close the underlying connection if it was created by this communicator or is closable
+func (communicator *ComponentCommunicator) Close() error {
+	if closer, ok := communicator.GrpcClient.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 type RemoteComponent interface {
 	Ping(ctx context.Context) error
 }
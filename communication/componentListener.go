@@ -3,6 +3,7 @@ package communication
 import (
 	"context"
 	"fmt"
+	"github.com/kulycloud/common/security"
 	protoCommon "github.com/kulycloud/protocol/common"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -16,12 +17,14 @@ type Listener struct {
 	Listener           net.Listener
 	logger             *zap.SugaredLogger
 	NewStorageHandlers []NewStorageHandler
+	Health             *HealthRegistry
 }
 
 func NewListener(logger *zap.SugaredLogger) *Listener {
 	return &Listener{
 		logger:             logger,
 		NewStorageHandlers: make([]NewStorageHandler, 0),
+		Health:             NewHealthRegistry(),
 	}
 }
 
@@ -30,10 +33,19 @@ func (listener *Listener) Setup(port uint32) error {
 	if err != nil {
 		return err
 	}
+	server, err := security.NewServer(nil,
+		grpc.ChainUnaryInterceptor(UnaryPanicInterceptor),
+		grpc.ChainStreamInterceptor(StreamPanicInterceptor),
+	)
+	if err != nil {
+		_ = lis.Close()
+		return err
+	}
 	listener.Listener = lis
-	listener.Server = grpc.NewServer()
+	listener.Server = server
 	listener.logger.Infow("created server", "port", port)
 	protoCommon.RegisterComponentServer(listener.Server, &componentHandler{listener: listener})
+	listener.Health.Register(listener.Server)
 	return nil
 }
 
@@ -41,15 +53,21 @@ func (listener *Listener) Setup(port uint32) error {
 // caller can decide when to wait for the result
 func (listener *Listener) Serve() <-chan error {
 	errChan := make(chan error)
-	go func() {
+	Go("serve", func() {
 		listener.logger.Infow("serving")
 		err := listener.Server.Serve(listener.Listener)
 		errChan <- err
 		close(errChan)
-	}()
+	})
 	return errChan
 }
 
+// Report NOT_SERVING and stop the server once pending calls are finished
+func (listener *Listener) Stop() {
+	listener.Health.Shutdown()
+	listener.Server.GracefulStop()
+}
+
 var _ protoCommon.ComponentServer = &componentHandler{}
 
 type componentHandler struct {
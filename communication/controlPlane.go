@@ -1,12 +1,14 @@
 package communication
 
 import (
+	"container/list"
 	"context"
 	"fmt"
-	"io"
+	"sync"
 	"time"
 
 	"github.com/kulycloud/common/logging"
+	"github.com/kulycloud/common/security"
 	protoCommon "github.com/kulycloud/protocol/common"
 	protoControlPlane "github.com/kulycloud/protocol/control-plane"
 	"google.golang.org/grpc"
@@ -18,123 +20,120 @@ type ControlPlaneCommunicator struct {
 	connection         *grpc.ClientConn
 	controlPlaneClient protoControlPlane.ControlPlaneClient
 
-	storageChangedHandlers       []StorageChangedHandler
-	configurationChangedHandlers []ConfigurationChangedHandler
-	clusterChangedHandlers       []ClusterChangedHandler
-	identifier                   string
-	Storage                      *StorageCommunicator
+	subscriptions      map[EventType][]*Subscription
+	subscriptionsMutex sync.RWMutex
+	fallback           *Subscription
+	// most recent event per type or resource, guarded by subscriptionsMutex
+	lastEvents map[string]Event
+	// number of subscriptions replaying each event type, events concerning resources are only remembered for those
+	replayTypes map[EventType]int
+	// keys of remembered events concerning resources, least recently updated first
+	resourceEvents        *list.List
+	resourceEventElements map[string]*list.Element
+	// serializes listening and stopping to listen at the control plane
+	listenMutex sync.Mutex
+
+	identifier        string
+	typeName          string
+	Storage           *StorageCommunicator
+	reconnectPolicy   RetryPolicy
+	transport         *security.Transport
+	dialOptions       []grpc.DialOption
+	cancelEventStream context.CancelFunc
+	// lifetime of the registration, ends when Close is called
+	ctx        context.Context
+	cancel     context.CancelFunc
+	background sync.WaitGroup
+
+	statusProviders []StatusProvider
+	statusMutex     sync.Mutex
+
+	connectionState         ConnectionState
+	connectionStateHandlers []ConnectionStateHandler
+	connectionStateMutex    sync.Mutex
 }
 
 func NewControlPlaneCommunicator() *ControlPlaneCommunicator {
 	return &ControlPlaneCommunicator{
-		storageChangedHandlers:       make([]StorageChangedHandler, 0),
-		configurationChangedHandlers: make([]ConfigurationChangedHandler, 0),
-		clusterChangedHandlers:       make([]ClusterChangedHandler, 0),
-		Storage:                      NewEmptyStorageCommunicator(),
+		subscriptions:   make(map[EventType][]*Subscription),
+		lastEvents:      make(map[string]Event),
+		Storage:         NewEmptyStorageCommunicator(),
+		reconnectPolicy: DefaultRetryPolicy(),
 	}
 }
 
 func NewControlPlaneCommunicatorWithoutStorage() *ControlPlaneCommunicator {
 	return &ControlPlaneCommunicator{
-		storageChangedHandlers:       make([]StorageChangedHandler, 0),
-		configurationChangedHandlers: make([]ConfigurationChangedHandler, 0),
-		clusterChangedHandlers:       make([]ClusterChangedHandler, 0),
-		Storage:                      nil,
+		subscriptions:   make(map[EventType][]*Subscription),
+		lastEvents:      make(map[string]Event),
+		Storage:         nil,
+		reconnectPolicy: DefaultRetryPolicy(),
 	}
 }
 
 func (communicator *ControlPlaneCommunicator) Connect(host string, port uint32) error {
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%v", host, port), grpc.WithInsecure())
+	conn, err := security.Dial(fmt.Sprintf("%s:%v", host, port), communicator.transport, communicator.dialOptions...)
 	if err != nil {
 		return err
 	}
+	communicator.connection = conn
 	communicator.controlPlaneClient = protoControlPlane.NewControlPlaneClient(conn)
 	return nil
 }
 
 // Register service asynchronously
 // the returned channel will either receive nil or an error that was encountered during setup, then close the channel
+// afterwards the event stream is supervised until ctx is done or Close is called: if it breaks it is re-established with backoff
 func (communicator *ControlPlaneCommunicator) RegisterThisService(ctx context.Context, typeName string, ownHost string, ownPort uint32) <-chan error {
-	done := make(chan error)
-	go func() {
+	ctx, communicator.cancel = context.WithCancel(ctx)
+	communicator.ctx = ctx
+	// buffered, so the result can be sent even if the caller stopped waiting
+	done := make(chan error, 1)
+	communicator.background.Add(1)
+	Go("register service", func() {
+		defer communicator.background.Done()
 		endpoint := &protoCommon.Endpoint{
 			Host: ownHost,
 			Port: ownPort,
 		}
-		stream, err := communicator.controlPlaneClient.RegisterComponent(ctx, &protoControlPlane.RegisterComponentRequest{
-			Type:     typeName,
-			Endpoint: endpoint,
-		})
-
-		if err != nil {
-			done <- err
-			return
+		// necessary to identify itself to the control plane
+		communicator.identifier = NewIdentifierFromEndpoint(endpoint)
+		communicator.typeName = typeName
+		if auth := security.DefaultAuth(); auth != nil {
+			auth.SetIdentity(security.Identity{Type: typeName, Name: communicator.identifier})
 		}
 
-		// validate the stream has been created
-		_, err = stream.Recv()
+		stream, err := communicator.openEventStream(ctx, typeName, endpoint)
 		if err != nil {
 			done <- err
 			return
 		}
+		communicator.setConnectionState(Connected)
 
-		// necessary to identify itself to the control plane
-		communicator.identifier = NewIdentifierFromEndpoint(endpoint)
-
-		// start receiving events from stream in the background
-		go func() {
-			for {
-				event, err := stream.Recv()
-				if err != nil {
-					if err != io.EOF {
-						logger.Warnw("could not receive data from stream", "error", err)
-					}
-					return
-				}
-				communicator.processEvent(event)
-			}
-		}()
-
-		// register for storage events in background if service requires storage events
+		// register for storage events if service requires storage events
 		if communicator.Storage != nil {
-			err = communicator.RegisterStorageChangedHandler(func(event *StorageChanged) {
-				// This logic will change when supporting multiple endpoints (tracked in KU-50)
-				var comm *ComponentCommunicator = nil
-				var err error = nil
-
-				if event.Endpoints != nil && len(event.Endpoints) > 0 {
-					comm, err = NewComponentCommunicatorFromEndpoint(event.Endpoints[0])
-
-					if err == nil {
-						err = comm.Ping(ctx)
-						if err != nil {
-							// We cannot ping the new storage. We should explicitly set it to nil
-							comm = nil
-						}
-					} else {
-						comm = nil
-					}
-				}
-
-				communicator.Storage.UpdateComponentCommunicator(comm)
-				communicator.Storage.Endpoints = event.Endpoints
-
+			_, err = communicator.RegisterStorageChangedHandler(func(event *StorageChanged) {
+				err := communicator.Storage.SetEndpoints(ctx, event.Endpoints)
 				if err != nil {
-					logger.Warnw("Error registering new storage endpoints", "endpoints", event.Endpoints)
+					logger.Warnw("Error registering new storage endpoints", "endpoints", event.Endpoints, "error", err)
 				} else {
 					logger.Infow("Registered new storage endpoints", "endpoints", event.Endpoints)
 				}
 			})
+			if err != nil {
+				communicator.setConnectionState(Disconnected)
+				done <- err
+				return
+			}
 		}
 
-		done <- err
+		done <- nil
 		close(done)
 
-		// keep this background task running until the stream is closed
+		// keep this background task running for as long as the service is registered
 		// otherwise the stream would be garbage collected, in turn closing the context
-		<-stream.Context().Done()
-		logger.Info("event stream closed")
-	}()
+		communicator.superviseEventStream(ctx, typeName, endpoint, stream)
+	})
 
 	return done
 }
@@ -144,114 +143,243 @@ func (communicator *ControlPlaneCommunicator) CreateEvent(event Event) error {
 	return err
 }
 
-// add handler to the list of handlers for StorageChanged events and requests control plane to listen on StorageChanged
-func (communicator *ControlPlaneCommunicator) RegisterStorageChangedHandler(handler StorageChangedHandler) error {
-	request := newListenToEventRequest(communicator.identifier, StorageChangedEvent)
-	_, err := communicator.controlPlaneClient.ListenToEvent(context.Background(), request)
-	if err != nil {
-		return err
+// Report a crash of this component to the control plane
+func (communicator *ControlPlaneCommunicator) ReportCrash(ctx context.Context, crash Crash) error {
+	event := NewComponentCrashed(communicator.typeName, communicator.identifier, crash)
+	_, err := communicator.controlPlaneClient.CreateEvent(ctx, event.ToGrpcEvent())
+	return err
+}
+
+// Deregister from the control plane and release all resources
+// Blocks until background tasks are finished or ctx is done
+func (communicator *ControlPlaneCommunicator) Close(ctx context.Context) error {
+	var firstErr error
+	keepFirst := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	communicator.storageChangedHandlers = append(communicator.storageChangedHandlers, handler)
-	return nil
+
+	// the event stream ends the registration as well, but this tells the control plane explicitly
+	if communicator.identifier != "" {
+		_, err := communicator.controlPlaneClient.CreateEvent(ctx, NewComponentDeregistered(communicator.typeName, communicator.identifier).ToGrpcEvent())
+		if err != nil {
+			logger.Warnw("could not deregister from control plane", "error", err)
+			keepFirst(err)
+		}
+	}
+
+	// stop listening to events
+	if communicator.cancel != nil {
+		communicator.cancel()
+	}
+	communicator.stopSubscriptions()
+
+	waitDone := make(chan struct{})
+	go func() {
+		communicator.background.Wait()
+		close(waitDone)
+	}()
+	select {
+	case <-waitDone:
+	case <-ctx.Done():
+		keepFirst(ctx.Err())
+	}
+
+	if communicator.Storage != nil {
+		keepFirst(communicator.Storage.Close())
+	}
+	if communicator.connection != nil {
+		keepFirst(communicator.connection.Close())
+	}
+	return firstErr
+}
+
+// add handler to the list of handlers for StorageChanged events and requests control plane to listen on StorageChanged
+func (communicator *ControlPlaneCommunicator) RegisterStorageChangedHandler(handler StorageChangedHandler, opts ...SubscribeOption) (*Subscription, error) {
+	return communicator.Subscribe(StorageChangedEvent, func(event Event) {
+		handler(event.(*StorageChanged))
+	}, opts...)
 }
 
 // add handler to the list of handlers for ConfigurationChanged events and requests control plane to listen on ConfigurationChanged
-func (communicator *ControlPlaneCommunicator) RegisterConfigurationChangedHandler(handler ConfigurationChangedHandler) error {
-	request := newListenToEventRequest(communicator.identifier, ConfigurationChangedEvent)
-	_, err := communicator.controlPlaneClient.ListenToEvent(context.Background(), request)
-	if err != nil {
-		return err
-	}
-	communicator.configurationChangedHandlers = append(communicator.configurationChangedHandlers, handler)
-	return nil
+func (communicator *ControlPlaneCommunicator) RegisterConfigurationChangedHandler(handler ConfigurationChangedHandler, opts ...SubscribeOption) (*Subscription, error) {
+	return communicator.Subscribe(ConfigurationChangedEvent, func(event Event) {
+		handler(event.(*ConfigurationChanged))
+	}, opts...)
 }
 
 // add handler to the list of handlers for ClusterChanged events and requests control plane to listen on ClusterChanged
-func (communicator *ControlPlaneCommunicator) RegisterClusterChangedHandler(handler ClusterChangedHandler) error {
-	request := newListenToEventRequest(communicator.identifier, ClusterChangedEvent)
-	_, err := communicator.controlPlaneClient.ListenToEvent(context.Background(), request)
-	if err != nil {
-		return err
+func (communicator *ControlPlaneCommunicator) RegisterClusterChangedHandler(handler ClusterChangedHandler, opts ...SubscribeOption) (*Subscription, error) {
+	return communicator.Subscribe(ClusterChangedEvent, func(event Event) {
+		handler(event.(*ClusterChanged))
+	}, opts...)
+}
+
+type RegisterOption func(*registerOptions)
+
+type registerOptions struct {
+	retryPolicy     RetryPolicy
+	reconnectPolicy RetryPolicy
+	transport       *security.Transport
+	dialOptions     []grpc.DialOption
+
+	heartbeatInterval time.Duration
+	statusProviders   []StatusProvider
+	storageCache      *CacheConfig
+}
+
+// Policy used to retry the initial registration, defaults to DefaultRetryPolicy
+func WithRetryPolicy(policy RetryPolicy) RegisterOption {
+	return func(options *registerOptions) {
+		options.retryPolicy = policy
 	}
-	communicator.clusterChangedHandlers = append(communicator.clusterChangedHandlers, handler)
-	return nil
 }
 
-// Register to the control plane asynchronously
-// If it cannot register to the control plane within 5 tries it will panic as it does not make sense to continue running
-// If it does not panic the returned channel will receive a valid *ControlPlaneCommunicator
+// Policy used to re-establish a broken event stream, defaults to DefaultRetryPolicy
+func WithReconnectPolicy(policy RetryPolicy) RegisterOption {
+	return func(options *registerOptions) {
+		options.reconnectPolicy = policy
+	}
+}
+
+// Transport used to connect to the control plane, defaults to security.DefaultTransport
+func WithTransport(transport *security.Transport) RegisterOption {
+	return func(options *registerOptions) {
+		options.transport = transport
+	}
+}
+
+// Additional options used to connect to the control plane
+func WithDialOptions(dialOptions ...grpc.DialOption) RegisterOption {
+	return func(options *registerOptions) {
+		options.dialOptions = append(options.dialOptions, dialOptions...)
+	}
+}
+
+// Register to the control plane in the background, retrying according to DefaultRetryPolicy
+// The channel receives the communicator once registered, use RegisterToControlPlaneContext to pass options or give up
+// It is closed without receiving a communicator if the retry policy gives up
 func RegisterToControlPlane(typeName string, host string, port uint32, cpHost string, cpPort uint32, withStorage bool) <-chan *ControlPlaneCommunicator {
 	communicator := make(chan *ControlPlaneCommunicator)
 
 	go func() {
-		var err error
-		var controlPlaneComm *ControlPlaneCommunicator
-		numberOfTries := 0
-		for {
-			numberOfTries++
-			controlPlaneComm, err = register(typeName, host, port, cpHost, cpPort, withStorage)
-			if err == nil || numberOfTries > 5 {
-				break
-			}
-
-			logger.Info("Retrying in 5s...")
-			time.Sleep(5 * time.Second)
-		}
+		defer close(communicator)
+		controlPlaneComm, err := RegisterToControlPlaneContext(context.Background(), typeName, host, port, cpHost, cpPort, withStorage)
 		if err != nil {
-			logger.Panicw("could not register to control plane", "lastError", err)
+			logger.Errorw("could not register to control plane", "lastError", err)
+			return
 		}
 
 		communicator <- controlPlaneComm
-		close(communicator)
 	}()
 
 	return communicator
 }
 
-func (communicator *ControlPlaneCommunicator) processEvent(event *protoCommon.Event) {
-	switch EventType(event.Type) {
-	case StorageChangedEvent:
-		sc := (*StorageChanged)(event.GetStorageChanged())
-		if sc != nil {
-			for _, handler := range communicator.storageChangedHandlers {
-				handler(sc)
-			}
-		}
-	case ConfigurationChangedEvent:
-		cc := (*ConfigurationChanged)(event.GetConfigurationChanged())
-		if cc != nil {
-			for _, handler := range communicator.configurationChangedHandlers {
-				handler(cc)
-			}
-		}
-	case ClusterChangedEvent:
-		cc := (*ClusterChanged)(event.GetClusterChanged())
-		if cc != nil {
-			for _, handler := range communicator.clusterChangedHandlers {
-				handler(cc)
-			}
+// Register to the control plane, retrying according to the retry policy
+// Blocks until the component is registered, the policy gives up or ctx is done, ctx aborts the current attempt as well.
+// Once registered, the registration lasts until Close is called regardless of ctx.
+// Run it in the background to serve requests while waiting for the control plane
+func RegisterToControlPlaneContext(ctx context.Context, typeName string, host string, port uint32, cpHost string, cpPort uint32, withStorage bool, opts ...RegisterOption) (*ControlPlaneCommunicator, error) {
+	options := &registerOptions{
+		retryPolicy:     DefaultRetryPolicy(),
+		reconnectPolicy: DefaultRetryPolicy(),
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	var controlPlaneComm *ControlPlaneCommunicator
+	err := options.retryPolicy.Retry(ctx, func() error {
+		var err error
+		controlPlaneComm, err = register(ctx, typeName, host, port, cpHost, cpPort, withStorage, options)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not register to control plane: %w", err)
+	}
+
+	SetCrashReporter(controlPlaneComm)
+	return controlPlaneComm, nil
+}
+
+func (communicator *ControlPlaneCommunicator) processEvent(grpcEvent *protoCommon.Event) {
+	event, known, err := DecodeEvent(grpcEvent)
+	if err != nil {
+		logger.Warnw("could not decode event", "type", grpcEvent.Type, "error", err)
+		return
+	}
+
+	if !known {
+		if fallback := communicator.getFallback(); fallback != nil {
+			fallback.deliver(event)
 		}
 	}
+	for _, subscription := range communicator.recordEvent(event) {
+		subscription.deliver(event)
+	}
 }
 
-func register(typeName string, host string, port uint32, cpHost string, cpPort uint32, withStorage bool) (*ControlPlaneCommunicator, error) {
+func register(ctx context.Context, typeName string, host string, port uint32, cpHost string, cpPort uint32, withStorage bool, options *registerOptions) (*ControlPlaneCommunicator, error) {
 	var comm *ControlPlaneCommunicator
 	if withStorage {
 		comm = NewControlPlaneCommunicator()
 	} else {
 		comm = NewControlPlaneCommunicatorWithoutStorage()
 	}
+	comm.reconnectPolicy = options.reconnectPolicy
+	comm.transport = options.transport
+	comm.dialOptions = options.dialOptions
 
 	err := comm.Connect(cpHost, cpPort)
 	if err != nil {
 		logger.Errorw("Could not connect to control-plane", "error", err)
+		comm.abortRegistration()
 		return nil, err
 	}
-	err = <-comm.RegisterThisService(context.Background(), typeName, host, port)
+	// the registration outlives ctx, so the attempt is aborted by cancelling the registration and closing the connection
+	done := comm.RegisterThisService(context.Background(), typeName, host, port)
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		comm.cancel()
+		_ = comm.connection.Close()
+		<-done
+		err = ctx.Err()
+	}
 	if err != nil {
 		logger.Errorw("Could not register service", "error", err)
+		comm.abortRegistration()
 		return nil, err
 	}
 	logger.Info("Registered to control-plane")
+
+	if comm.Storage != nil {
+		if options.storageCache != nil {
+			comm.Storage.EnableCache(*options.storageCache)
+		}
+		comm.forwardStorageChanges()
+	}
+
+	for _, provider := range options.statusProviders {
+		comm.AddStatusProvider(provider)
+	}
+	if options.heartbeatInterval > 0 {
+		if err := comm.StartHeartbeat(options.heartbeatInterval); err != nil {
+			logger.Warnw("Could not start heartbeat", "error", err)
+		}
+	}
 	return comm, nil
 }
+
+// release everything a failed registration attempt acquired, so retrying does not leak supervisors or connections
+func (communicator *ControlPlaneCommunicator) abortRegistration() {
+	if communicator.cancel != nil {
+		communicator.cancel()
+	}
+	communicator.stopSubscriptions()
+	if communicator.connection != nil {
+		_ = communicator.connection.Close()
+	}
+}
@@ -0,0 +1,113 @@
+package communication
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/kulycloud/common/logging"
+	"google.golang.org/grpc"
+)
+
+const crashReportTimeout = 5 * time.Second
+
+// Crash describes a panic recovered by this library
+type Crash struct {
+	Reason string
+	Stack  string
+	// the panic was confined to an event handler, the component keeps running
+	Recovered bool
+}
+
+// CrashReporter is notified about a panic right before the component exits
+// Panics of event handlers are reported as well, the component keeps running in this case
+type CrashReporter interface {
+	ReportCrash(ctx context.Context, crash Crash) error
+}
+
+var (
+	crashReporter      CrashReporter
+	crashReporterMutex sync.RWMutex
+	exit               = os.Exit
+	exitMutex          sync.RWMutex
+)
+
+// Set the reporter that is used to report panics recovered by this library
+// RegisterToControlPlane and RegisterToControlPlaneContext automatically set the registered ControlPlaneCommunicator
+func SetCrashReporter(reporter CrashReporter) {
+	crashReporterMutex.Lock()
+	defer crashReporterMutex.Unlock()
+	crashReporter = reporter
+}
+
+func getCrashReporter() CrashReporter {
+	crashReporterMutex.RLock()
+	defer crashReporterMutex.RUnlock()
+	return crashReporter
+}
+
+// Set the function that exits the component after a crash was reported, defaults to os.Exit
+// Embedders can use it to keep the process running
+func SetExitFunc(exitFunc func(code int)) {
+	exitMutex.Lock()
+	defer exitMutex.Unlock()
+	exit = exitFunc
+}
+
+func getExitFunc() func(code int) {
+	exitMutex.RLock()
+	defer exitMutex.RUnlock()
+	return exit
+}
+
+// Recover a panic, log it with its stack trace, report it and exit the component
+// This has to be deferred directly (defer RecoverPanic("location")), otherwise the panic cannot be recovered
+func RecoverPanic(location string) {
+	if value := recover(); value != nil {
+		crash(location, value)
+	}
+}
+
+// Start fn in a goroutine whose panics are reported before exiting
+func Go(location string, fn func()) {
+	go func() {
+		defer RecoverPanic(location)
+		fn()
+	}()
+}
+
+func crash(location string, value interface{}) {
+	stack := string(debug.Stack())
+	logger.Errorw("recovered panic", "location", location, "panic", value, "stack", stack)
+	reportCrash(Crash{Reason: fmt.Sprintf("%s: %v", location, value), Stack: stack})
+
+	logging.Sync()
+	getExitFunc()(2)
+}
+
+func reportCrash(crash Crash) {
+	reporter := getCrashReporter()
+	if reporter == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), crashReportTimeout)
+	defer cancel()
+	if err := reporter.ReportCrash(ctx, crash); err != nil {
+		logger.Warnw("could not report crash", "error", err)
+	}
+}
+
+// Server interceptor that reports panics inside of unary handlers
+func UnaryPanicInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	defer RecoverPanic(info.FullMethod)
+	return handler(ctx, req)
+}
+
+// Server interceptor that reports panics inside of stream handlers
+func StreamPanicInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	defer RecoverPanic(info.FullMethod)
+	return handler(srv, stream)
+}
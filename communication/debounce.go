@@ -0,0 +1,103 @@
+package communication
+
+import (
+	"sync"
+	"time"
+)
+
+// Coalesce events concerning the same resource and only deliver the latest one
+// once no further event arrived within window
+// maxDelay bounds how long the first event of a burst may be held back, 0 disables the bound
+func WithDebounce(window time.Duration, maxDelay time.Duration) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.debounceWindow = window
+		options.debounceMaxDelay = maxDelay
+	}
+}
+
+type pendingEvent struct {
+	event Event
+	first time.Time
+	timer *time.Timer
+}
+
+// holds back events per resource until their window passed
+type debouncer struct {
+	window   time.Duration
+	maxDelay time.Duration
+	deliver  func(Event)
+	mutex    sync.Mutex
+	pending  map[string]*pendingEvent
+	stopped  bool
+}
+
+func newDebouncer(window time.Duration, maxDelay time.Duration, deliver func(Event)) *debouncer {
+	return &debouncer{
+		window:   window,
+		maxDelay: maxDelay,
+		deliver:  deliver,
+		pending:  make(map[string]*pendingEvent),
+	}
+}
+
+func (d *debouncer) add(event Event) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return
+	}
+
+	key := eventKey(event)
+	now := time.Now()
+	pending, ok := d.pending[key]
+	if !ok {
+		pending = &pendingEvent{event: event, first: now}
+		d.pending[key] = pending
+		pending.timer = time.AfterFunc(d.delay(pending, now), func() {
+			d.fire(key, pending)
+		})
+		return
+	}
+
+	// if the timer already fired, fire delivers this event and the reset timer finds nothing to deliver
+	pending.event = event
+	pending.timer.Reset(d.delay(pending, now))
+}
+
+func (d *debouncer) delay(pending *pendingEvent, now time.Time) time.Duration {
+	delay := d.window
+	if d.maxDelay > 0 {
+		remaining := pending.first.Add(d.maxDelay).Sub(now)
+		if remaining < delay {
+			delay = remaining
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+func (d *debouncer) fire(key string, pending *pendingEvent) {
+	d.mutex.Lock()
+	if d.stopped || d.pending[key] != pending {
+		d.mutex.Unlock()
+		return
+	}
+	delete(d.pending, key)
+	event := pending.event
+	d.mutex.Unlock()
+
+	d.deliver(event)
+}
+
+// discard all pending events
+func (d *debouncer) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.stopped = true
+	for key, pending := range d.pending {
+		pending.timer.Stop()
+		delete(d.pending, key)
+	}
+}
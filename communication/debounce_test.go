@@ -0,0 +1,84 @@
+package communication
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func clusterChanged(name string, services uint32) *ClusterChanged {
+	return NewClusterChanged(NewResource("cluster", "", name), NewInstanceCount(services, services), nil)
+}
+
+// collects delivered events together with the time they were delivered at
+type delivery struct {
+	mutex  sync.Mutex
+	events []*ClusterChanged
+	times  []time.Time
+}
+
+func (d *delivery) deliver(event Event) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.events = append(d.events, event.(*ClusterChanged))
+	d.times = append(d.times, time.Now())
+}
+
+func (d *delivery) get() ([]*ClusterChanged, []time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]*ClusterChanged(nil), d.events...), append([]time.Time(nil), d.times...)
+}
+
+func TestDebounceCoalescesEventsPerResource(t *testing.T) {
+	delivered := &delivery{}
+	d := newDebouncer(50*time.Millisecond, 0, delivered.deliver)
+	defer d.stop()
+
+	d.add(clusterChanged("a", 1))
+	d.add(clusterChanged("b", 1))
+	d.add(clusterChanged("a", 2))
+	d.add(clusterChanged("a", 3))
+	if events, _ := delivered.get(); len(events) != 0 {
+		t.Fatalf("events were delivered before the window passed: %v", events)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	events, _ := delivered.get()
+	if len(events) != 2 {
+		t.Fatalf("expected one event per resource, got %d", len(events))
+	}
+	latest := make(map[string]uint32)
+	for _, event := range events {
+		latest[event.Resource.Name] = event.ServiceCount.Actual
+	}
+	if latest["a"] != 3 || latest["b"] != 1 {
+		t.Fatalf("expected the latest event of every resource, got %v", latest)
+	}
+}
+
+func TestDebounceMaxDelayBoundsHoldBack(t *testing.T) {
+	delivered := &delivery{}
+	d := newDebouncer(50*time.Millisecond, 120*time.Millisecond, delivered.deliver)
+	defer d.stop()
+
+	// every event resets the window, so without maxDelay nothing would be delivered before the burst ends
+	start := time.Now()
+	for i := uint32(1); i <= 20; i++ {
+		d.add(clusterChanged("a", i))
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	events, times := delivered.get()
+	if len(events) < 2 {
+		t.Fatalf("expected events to be delivered during the burst, got %d", len(events))
+	}
+	// the burst takes at least 400ms
+	if held := times[0].Sub(start); held > 250*time.Millisecond {
+		t.Fatalf("first event was held back for %v", held)
+	}
+	if last := events[len(events)-1].ServiceCount.Actual; last != 20 {
+		t.Fatalf("expected the last event to be delivered eventually, got %d", last)
+	}
+}
@@ -0,0 +1,259 @@
+package communication
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+)
+
+// Member is a component known to a Discovery
+type Member struct {
+	Type       string
+	Identifier string
+	Endpoint   *protoCommon.Endpoint
+	LastSeen   time.Time
+}
+
+type MembershipChange struct {
+	Member Member
+	// false if the member left
+	Joined bool
+}
+
+type MembershipHandler func(MembershipChange)
+
+// Discovery keeps track of the registered components of some types
+// The control plane cannot be asked for its components, so membership is learned from
+// component events: components join when they register or report their status and leave when they
+// deregister or crash. Membership is best-effort: a new discovery is seeded with the component events
+// this communicator remembers for replay, which are only those received while another replaying subscription
+// existed, e.g. an earlier discovery. Other components that registered before the discovery was started are only
+// known once they report their status, so components should send heartbeats, see WithHeartbeat.
+type Discovery struct {
+	communicator  *ControlPlaneCommunicator
+	ttl           time.Duration
+	subscriptions []*Subscription
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	mutex    sync.RWMutex
+	members  map[string]map[string]*Member
+	handlers []MembershipHandler
+}
+
+// Start discovering components of the given types, all types are discovered if none are given
+// Members that were not seen for ttl are removed, 0 keeps them until they leave
+func (communicator *ControlPlaneCommunicator) Discover(ttl time.Duration, types ...string) (*Discovery, error) {
+	if communicator.identifier == "" {
+		return nil, ErrNotRegistered
+	}
+	discovery := &Discovery{
+		communicator: communicator,
+		ttl:          ttl,
+		done:         make(chan struct{}),
+		members:      make(map[string]map[string]*Member),
+	}
+
+	filters := make([]ResourceFilter, 0, len(types))
+	for _, typeName := range types {
+		filters = append(filters, ResourceFilter{Type: ComponentResourceType, Namespace: typeName})
+	}
+	if len(filters) == 0 {
+		filters = append(filters, ResourceFilter{Type: ComponentResourceType})
+	}
+
+	// events of components that left are not remembered, so only joining ones are replayed
+	eventTypes := []EventType{ComponentRegisteredEvent, ComponentStatusEvent, ComponentDeregisteredEvent, ComponentCrashedEvent}
+	for _, eventType := range eventTypes {
+		opts := []SubscribeOption{WithResourceFilter(filters...)}
+		if eventType == ComponentRegisteredEvent || eventType == ComponentStatusEvent {
+			opts = append(opts, WithReplay())
+		}
+		subscription, err := communicator.Subscribe(eventType, discovery.processEvent, opts...)
+		if err != nil {
+			discovery.Close()
+			return nil, err
+		}
+		discovery.subscriptions = append(discovery.subscriptions, subscription)
+	}
+
+	if ttl > 0 {
+		communicator.background.Add(1)
+		Go("discovery expiry", func() {
+			defer communicator.background.Done()
+			discovery.expireMembers()
+		})
+	}
+	return discovery, nil
+}
+
+// Stop discovering, the members known so far remain available
+func (discovery *Discovery) Close() {
+	discovery.closeOnce.Do(func() {
+		close(discovery.done)
+		for _, subscription := range discovery.subscriptions {
+			if err := subscription.Unsubscribe(); err != nil {
+				logger.Warnw("could not unsubscribe from component events", "error", err)
+			}
+		}
+	})
+}
+
+// add handler that is called every time a member joins or leaves
+func (discovery *Discovery) OnChange(handler MembershipHandler) {
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+	discovery.handlers = append(discovery.handlers, handler)
+}
+
+// Members of typeName ordered by identifier
+func (discovery *Discovery) Members(typeName string) []Member {
+	discovery.mutex.RLock()
+	defer discovery.mutex.RUnlock()
+	members := make([]Member, 0, len(discovery.members[typeName]))
+	for _, member := range discovery.members[typeName] {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Identifier < members[j].Identifier
+	})
+	return members
+}
+
+// Endpoints of the members of typeName ordered by identifier
+func (discovery *Discovery) Endpoints(typeName string) []*protoCommon.Endpoint {
+	members := discovery.Members(typeName)
+	endpoints := make([]*protoCommon.Endpoint, 0, len(members))
+	for _, member := range members {
+		if member.Endpoint != nil {
+			endpoints = append(endpoints, member.Endpoint)
+		}
+	}
+	return endpoints
+}
+
+func (discovery *Discovery) processEvent(event Event) {
+	componentEvent, ok := event.(*ComponentEvent)
+	if !ok {
+		return
+	}
+	typeName := componentEvent.Component.Namespace
+	identifier := componentEvent.Component.Name
+
+	switch componentEvent.Type {
+	case ComponentCrashedEvent:
+		// panics of event handlers are reported as crashes, but the component keeps running
+		if crash, _ := componentEvent.Crash(); crash.Recovered {
+			discovery.join(typeName, identifier)
+			return
+		}
+		discovery.leave(typeName, identifier)
+	case ComponentDeregisteredEvent:
+		discovery.leave(typeName, identifier)
+	default:
+		discovery.join(typeName, identifier)
+	}
+}
+
+func (discovery *Discovery) join(typeName string, identifier string) {
+	discovery.mutex.Lock()
+	members, ok := discovery.members[typeName]
+	if !ok {
+		members = make(map[string]*Member)
+		discovery.members[typeName] = members
+	}
+	if member, ok := members[identifier]; ok {
+		member.LastSeen = time.Now()
+		discovery.mutex.Unlock()
+		return
+	}
+	member := &Member{
+		Type:       typeName,
+		Identifier: identifier,
+		Endpoint:   endpointFromIdentifier(identifier),
+		LastSeen:   time.Now(),
+	}
+	members[identifier] = member
+	handlers := discovery.getHandlers()
+	discovery.mutex.Unlock()
+
+	logger.Infow("component joined", "type", typeName, "identifier", identifier)
+	notifyMembershipHandlers(handlers, MembershipChange{Member: *member, Joined: true})
+}
+
+func (discovery *Discovery) leave(typeName string, identifier string) {
+	discovery.mutex.Lock()
+	member, ok := discovery.members[typeName][identifier]
+	if !ok {
+		discovery.mutex.Unlock()
+		return
+	}
+	delete(discovery.members[typeName], identifier)
+	handlers := discovery.getHandlers()
+	discovery.mutex.Unlock()
+
+	logger.Infow("component left", "type", typeName, "identifier", identifier)
+	notifyMembershipHandlers(handlers, MembershipChange{Member: *member, Joined: false})
+}
+
+func (discovery *Discovery) expireMembers() {
+	ticker := time.NewTicker(discovery.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-discovery.done:
+			return
+		case <-discovery.communicator.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		discovery.mutex.Lock()
+		expired := make([]Member, 0)
+		for _, members := range discovery.members {
+			for identifier, member := range members {
+				if time.Since(member.LastSeen) > discovery.ttl {
+					expired = append(expired, *member)
+					delete(members, identifier)
+				}
+			}
+		}
+		handlers := discovery.getHandlers()
+		discovery.mutex.Unlock()
+
+		for _, member := range expired {
+			logger.Infow("component expired", "type", member.Type, "identifier", member.Identifier)
+			notifyMembershipHandlers(handlers, MembershipChange{Member: member, Joined: false})
+		}
+	}
+}
+
+// has to be called while holding the mutex
+func (discovery *Discovery) getHandlers() []MembershipHandler {
+	handlers := make([]MembershipHandler, len(discovery.handlers))
+	copy(handlers, discovery.handlers)
+	return handlers
+}
+
+func notifyMembershipHandlers(handlers []MembershipHandler, change MembershipChange) {
+	for _, handler := range handlers {
+		handler(change)
+	}
+}
+
+// identifiers are created by NewIdentifierFromEndpoint, returns nil for anything else
+func endpointFromIdentifier(identifier string) *protoCommon.Endpoint {
+	host, port, err := net.SplitHostPort(identifier)
+	if err != nil {
+		return nil
+	}
+	parsedPort, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return nil
+	}
+	return &protoCommon.Endpoint{Host: host, Port: uint32(parsedPort)}
+}
@@ -0,0 +1,63 @@
+package communication_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+)
+
+func discover(t *testing.T, communicator *communication.ControlPlaneCommunicator) *communication.Discovery {
+	t.Helper()
+	discovery, err := communicator.Discover(0, "worker")
+	if err != nil {
+		t.Fatalf("could not discover: %v", err)
+	}
+	t.Cleanup(discovery.Close)
+	return discovery
+}
+
+func isMember(discovery *communication.Discovery, identifier string) bool {
+	for _, member := range discovery.Members("worker") {
+		if member.Identifier == identifier {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiscoveryIsSeededWithRememberedComponents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, 7)
+
+	first := discover(t, communicator)
+	worker, err := controlPlane.Register(context.Background(), "worker", "localhost", 8, false)
+	if err != nil {
+		t.Fatalf("could not register: %v", err)
+	}
+	eventually(t, func() bool { return isMember(first, "localhost:8") }, "registered component was not discovered")
+
+	// the component registered before the discovery was started
+	second := discover(t, communicator)
+	eventually(t, func() bool { return isMember(second, "localhost:8") }, "discovery was not seeded with the registered component")
+
+	if err := worker.Close(context.Background()); err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+	eventually(t, func() bool { return !isMember(second, "localhost:8") }, "deregistered component is still a member")
+	if isMember(discover(t, communicator), "localhost:8") {
+		t.Fatal("discovery was seeded with a deregistered component")
+	}
+
+	// registering again must not be undone by replaying the deregistration
+	worker, err = controlPlane.Register(context.Background(), "worker", "localhost", 8, false)
+	if err != nil {
+		t.Fatalf("could not register: %v", err)
+	}
+	defer worker.Close(context.Background())
+	eventually(t, func() bool { return isMember(first, "localhost:8") }, "registered component was not discovered")
+	third := discover(t, communicator)
+	eventually(t, func() bool { return isMember(third, "localhost:8") }, "discovery was not seeded with the registered component")
+}
@@ -0,0 +1,269 @@
+package communication
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+)
+
+const defaultQueueSize = 64
+
+// OverflowPolicy decides what happens to an event if the queue of a subscription is full
+type OverflowPolicy int
+
+const (
+	// wait until the handler made room, this stalls delivery to all other subscriptions
+	Block OverflowPolicy = iota
+	// discard the oldest queued event
+	DropOldest
+	// replace queued events concerning the same resource, discard the oldest event if there is none
+	Coalesce
+)
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	queueSize      int
+	overflowPolicy OverflowPolicy
+	replay         bool
+	filters        []ResourceFilter
+
+	debounceWindow   time.Duration
+	debounceMaxDelay time.Duration
+}
+
+func newSubscribeOptions(opts []SubscribeOption) *subscribeOptions {
+	options := &subscribeOptions{
+		queueSize:      defaultQueueSize,
+		overflowPolicy: Block,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.queueSize < 1 {
+		options.queueSize = 1
+	}
+	return options
+}
+
+func (options *subscribeOptions) validate() error {
+	for _, filter := range options.filters {
+		if err := filter.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Number of events that can be queued for the handler, defaults to 64
+func WithQueueSize(size int) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.queueSize = size
+	}
+}
+
+// What to do if the queue is full, defaults to Block
+func WithOverflowPolicy(policy OverflowPolicy) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.overflowPolicy = policy
+	}
+}
+
+type SubscriptionMetrics struct {
+	QueueDepth   int
+	Delivered    uint64
+	Dropped      uint64
+	Panics       uint64
+	LastLatency  time.Duration
+	TotalLatency time.Duration
+}
+
+// bounded queue of events waiting for a single handler
+type eventQueue struct {
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	events   []Event
+	size     int
+	policy   OverflowPolicy
+	closed   bool
+	dropped  uint64
+}
+
+func newEventQueue(size int, policy OverflowPolicy) *eventQueue {
+	queue := &eventQueue{
+		events: make([]Event, 0, size),
+		size:   size,
+		policy: policy,
+	}
+	queue.notEmpty = sync.NewCond(&queue.mutex)
+	queue.notFull = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+func (queue *eventQueue) push(event Event) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.policy == Coalesce {
+		key := eventKey(event)
+		for i, queued := range queue.events {
+			if eventKey(queued) == key {
+				queue.events[i] = event
+				queue.dropped++
+				return
+			}
+		}
+	}
+
+	for len(queue.events) >= queue.size && !queue.closed {
+		if queue.policy == Block {
+			queue.notFull.Wait()
+			continue
+		}
+		queue.events = queue.events[1:]
+		queue.dropped++
+	}
+	if queue.closed {
+		return
+	}
+	queue.events = append(queue.events, event)
+	queue.notEmpty.Signal()
+}
+
+// queue events regardless of the overflow policy, used to replay state to a new subscription
+func (queue *eventQueue) prefill(events []Event) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.events = append(queue.events, events...)
+	queue.notEmpty.Signal()
+}
+
+// returns false once the queue is closed
+func (queue *eventQueue) pop() (Event, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for len(queue.events) == 0 && !queue.closed {
+		queue.notEmpty.Wait()
+	}
+	if queue.closed {
+		return nil, false
+	}
+	event := queue.events[0]
+	queue.events = queue.events[1:]
+	queue.notFull.Signal()
+	return event, true
+}
+
+// discard queued events and wake up everybody waiting
+func (queue *eventQueue) close() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.closed = true
+	queue.events = nil
+	queue.notEmpty.Broadcast()
+	queue.notFull.Broadcast()
+}
+
+func (queue *eventQueue) stats() (int, uint64) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.events), queue.dropped
+}
+
+// filter, debounce and queue event for the handler
+func (subscription *Subscription) deliver(event Event) {
+	if !subscription.accepts(event) {
+		return
+	}
+	if subscription.debouncer != nil {
+		subscription.debouncer.add(event)
+		return
+	}
+	subscription.queue.push(event)
+}
+
+// discard pending events and stop the worker
+func (subscription *Subscription) stop() {
+	if subscription.debouncer != nil {
+		subscription.debouncer.stop()
+	}
+	subscription.queue.close()
+}
+
+// run handler for every queued event until the queue is closed
+func (subscription *Subscription) work() {
+	for {
+		event, ok := subscription.queue.pop()
+		if !ok {
+			return
+		}
+		subscription.handle(event)
+	}
+}
+
+func (subscription *Subscription) handle(event Event) {
+	start := time.Now()
+	defer func() {
+		latency := time.Since(start)
+		value := recover()
+
+		subscription.metricsMutex.Lock()
+		defer subscription.metricsMutex.Unlock()
+		subscription.metrics.Delivered++
+		subscription.metrics.LastLatency = latency
+		subscription.metrics.TotalLatency += latency
+		if value != nil {
+			subscription.metrics.Panics++
+			stack := string(debug.Stack())
+			logger.Errorw("recovered panic in event handler", "eventType", subscription.eventType, "panic", value, "stack", stack)
+			// the handler keeps running, so the crash is reported without blocking it
+			crash := Crash{Reason: fmt.Sprintf("event handler for %s: %v", subscription.eventType, value), Stack: stack, Recovered: true}
+			Go("report event handler panic", func() {
+				reportCrash(crash)
+			})
+		}
+	}()
+	subscription.handler(event)
+}
+
+// Metrics of the handler, QueueDepth is the number of events currently waiting
+func (subscription *Subscription) Metrics() SubscriptionMetrics {
+	depth, dropped := subscription.queue.stats()
+	subscription.metricsMutex.Lock()
+	defer subscription.metricsMutex.Unlock()
+	metrics := subscription.metrics
+	metrics.QueueDepth = depth
+	metrics.Dropped = dropped
+	return metrics
+}
+
+// events concerning the same resource share a key, other events are keyed by their type only
+func eventKey(event Event) string {
+	resource := eventResource(event)
+	if resource == nil {
+		return string(event.GetType())
+	}
+	return resourceEventKey(event.GetType(), resource)
+}
+
+func resourceEventKey(eventType EventType, resource *protoCommon.Resource) string {
+	return fmt.Sprintf("%s/%s/%s/%s", eventType, resource.Type, resource.Namespace, resource.Name)
+}
+
+func eventResource(event Event) *protoCommon.Resource {
+	switch e := event.(type) {
+	case *ConfigurationChanged:
+		return e.Resource
+	case *ClusterChanged:
+		return e.Resource
+	case *ComponentEvent:
+		return e.Component
+	default:
+		return nil
+	}
+}
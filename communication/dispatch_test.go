@@ -0,0 +1,145 @@
+package communication_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+)
+
+func pushConfigurationChanged(controlPlane *fake.ControlPlane, names ...string) {
+	for _, name := range names {
+		controlPlane.Push(communication.NewConfigurationChanged(communication.NewResource("route", "default", name)).ToGrpcEvent())
+	}
+}
+
+// subscribes a handler blocking on the first event until release is called, which returns the names received
+func subscribeBlocked(t *testing.T, controlPlane *fake.ControlPlane, port uint32, opts ...communication.SubscribeOption) (*communication.Subscription, func() []string) {
+	t.Helper()
+	communicator := register(t, controlPlane, port)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var received []string
+	subscription, err := communicator.Subscribe(communication.ConfigurationChangedEvent, func(event communication.Event) {
+		mutex.Lock()
+		first := len(received) == 0
+		received = append(received, event.(*communication.ConfigurationChanged).Resource.Name)
+		mutex.Unlock()
+		if first {
+			close(started)
+			<-release
+		}
+	}, opts...)
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	pushConfigurationChanged(controlPlane, "first")
+	select {
+	case <-started:
+	case <-time.After(waitTimeout):
+		t.Fatal("first event was not delivered")
+	}
+	return subscription, func() []string {
+		close(release)
+		// the queue is empty once the last event is being handled
+		eventually(t, func() bool { return subscription.Metrics().QueueDepth == 0 }, "queued events were not delivered")
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), received...)
+	}
+}
+
+func queued(t *testing.T, subscription *communication.Subscription, depth int, dropped uint64) {
+	t.Helper()
+	eventually(t, func() bool {
+		metrics := subscription.Metrics()
+		return metrics.QueueDepth == depth && metrics.Dropped == dropped
+	}, "events were not queued as expected")
+}
+
+func TestDropOldestDiscardsTheOldestQueuedEvent(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	subscription, release := subscribeBlocked(t, controlPlane, 12, communication.WithQueueSize(2), communication.WithOverflowPolicy(communication.DropOldest))
+
+	pushConfigurationChanged(controlPlane, "a", "b", "c")
+	queued(t, subscription, 2, 1)
+	if received := release(); !reflect.DeepEqual(received, []string{"first", "b", "c"}) {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestCoalesceReplacesEventsOfTheSameResource(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	subscription, release := subscribeBlocked(t, controlPlane, 13, communication.WithQueueSize(2), communication.WithOverflowPolicy(communication.Coalesce))
+
+	pushConfigurationChanged(controlPlane, "a", "b", "a")
+	queued(t, subscription, 2, 1)
+	// no queued event concerns c, so the oldest one is discarded
+	pushConfigurationChanged(controlPlane, "c")
+	queued(t, subscription, 2, 2)
+	if received := release(); !reflect.DeepEqual(received, []string{"first", "b", "c"}) {
+		t.Fatalf("unexpected events: %v", received)
+	}
+}
+
+func TestBlockKeepsAllEvents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	subscription, release := subscribeBlocked(t, controlPlane, 14, communication.WithQueueSize(1))
+
+	pushConfigurationChanged(controlPlane, "a", "b", "c")
+	queued(t, subscription, 1, 0)
+	time.Sleep(50 * time.Millisecond)
+	if metrics := subscription.Metrics(); metrics.QueueDepth != 1 || metrics.Dropped != 0 {
+		t.Fatalf("queue grew or dropped events while blocked: %+v", metrics)
+	}
+	if received := release(); !reflect.DeepEqual(received, []string{"first", "a", "b", "c"}) {
+		t.Fatalf("unexpected events: %v", received)
+	}
+	if metrics := subscription.Metrics(); metrics.Delivered != 4 || metrics.Dropped != 0 || metrics.TotalLatency < metrics.LastLatency {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestPanickingHandlerKeepsReceivingEvents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, 15)
+
+	received := make(chan string, 2)
+	subscription, err := communicator.Subscribe(communication.ConfigurationChangedEvent, func(event communication.Event) {
+		name := event.(*communication.ConfigurationChanged).Resource.Name
+		received <- name
+		if name == "panic" {
+			panic("handler failed")
+		}
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	pushConfigurationChanged(controlPlane, "panic", "later")
+	for _, expected := range []string{"panic", "later"} {
+		select {
+		case name := <-received:
+			if name != expected {
+				t.Fatalf("expected %s, got %s", expected, name)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("%s was not delivered", expected)
+		}
+	}
+	eventually(t, func() bool {
+		metrics := subscription.Metrics()
+		return metrics.Delivered == 2 && metrics.Panics == 1
+	}, "panic was not counted")
+}
@@ -0,0 +1,185 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrElectionWithoutStorage = errors.New("leader election requires storage")
+var ErrNotRegistered = errors.New("component is not registered to the control plane")
+var ErrInvalidTTL = errors.New("lease ttl must be positive")
+
+// LeaderChangeHandler is called when this replica gains or loses leadership
+// token is the fencing token of the term, it is 0 when leadership is lost
+type LeaderChangeHandler func(leader bool, token uint64)
+
+// Election elects a single leader among all replicas campaigning for the same name
+// The lease is kept in storage: the leader renews it every third of its TTL and steps down
+// once it could not renew it within the TTL. Every new term increments the fencing token,
+// which should be passed along to writes that must only be performed by the leader.
+// Leases are named after the election and written with an expected version, so only one of the replicas acquiring
+// it at the same time succeeds. Campaign fails with ErrVersionsNotEnforced if the storage does not check the
+// expected version (see ExpectedVersionMetadataKey). The clocks of the replicas have to be reasonably synchronized.
+type Election struct {
+	communicator *ControlPlaneCommunicator
+	name         string
+	ttl          time.Duration
+
+	mutex    sync.Mutex
+	leader   bool
+	token    uint64
+	handlers []LeaderChangeHandler
+}
+
+func (communicator *ControlPlaneCommunicator) NewElection(name string, ttl time.Duration) *Election {
+	return &Election{
+		communicator: communicator,
+		name:         name,
+		ttl:          ttl,
+	}
+}
+
+// add handler that is called every time leadership changes
+func (election *Election) OnChange(handler LeaderChangeHandler) {
+	election.mutex.Lock()
+	defer election.mutex.Unlock()
+	election.handlers = append(election.handlers, handler)
+}
+
+func (election *Election) IsLeader() bool {
+	election.mutex.Lock()
+	defer election.mutex.Unlock()
+	return election.leader
+}
+
+// Fencing token of the current term, 0 if this replica is not the leader
+func (election *Election) Token() uint64 {
+	election.mutex.Lock()
+	defer election.mutex.Unlock()
+	return election.token
+}
+
+// Campaign for leadership until ctx is done, then resign
+// Blocks for the whole time, leadership changes are reported to the handlers
+func (election *Election) Campaign(ctx context.Context) error {
+	if election.communicator.Storage == nil {
+		return ErrElectionWithoutStorage
+	}
+	if election.communicator.identifier == "" {
+		return ErrNotRegistered
+	}
+	if election.ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	// without the storage checking versions several replicas could acquire the lease at the same time
+	checkCtx, cancel := context.WithTimeout(ctx, election.ttl)
+	err := election.communicator.Storage.checkVersionEnforcement(checkCtx, election.name)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	interval := election.ttl / 3
+	var termEnd time.Time
+	for {
+		start := time.Now()
+		attemptCtx, cancel := context.WithTimeout(ctx, interval)
+		token, err := election.tryAcquire(attemptCtx)
+		cancel()
+
+		switch {
+		case err != nil:
+			logger.Warnw("could not renew lease", "election", election.name, "error", err)
+			// keep leadership until the lease would have expired
+			if election.IsLeader() && time.Now().After(termEnd) {
+				election.setLeader(false, 0)
+			}
+		case token != 0:
+			termEnd = start.Add(election.ttl)
+			election.setLeader(true, token)
+		default:
+			election.setLeader(false, 0)
+		}
+
+		select {
+		case <-ctx.Done():
+			election.resign()
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// acquire or renew the lease, returns the fencing token or 0 if another replica holds it
+func (election *Election) tryAcquire(ctx context.Context) (uint64, error) {
+	current, version, err := election.communicator.Storage.getLease(ctx, election.name)
+	if err != nil {
+		return 0, err
+	}
+
+	identifier := election.communicator.identifier
+	now := time.Now()
+	if current.holder != identifier && now.Before(current.expiry) {
+		return 0, nil
+	}
+
+	acquired := lease{holder: identifier, expiry: now.Add(election.ttl), token: current.token}
+	if current.holder != identifier || !now.Before(current.expiry) {
+		acquired.token++
+	}
+	err = election.communicator.Storage.setLeaseIfVersion(ctx, election.name, acquired, version)
+	if errors.Is(err, ErrConflict) {
+		// another replica acquired the lease since it was read
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return acquired.token, nil
+}
+
+// release the lease so other replicas do not have to wait for it to expire
+func (election *Election) resign() {
+	token := election.Token()
+	if token == 0 {
+		return
+	}
+	election.setLeader(false, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), election.ttl/3)
+	defer cancel()
+	current, version, err := election.communicator.Storage.getLease(ctx, election.name)
+	if err != nil {
+		logger.Warnw("could not release lease", "election", election.name, "error", err)
+		return
+	}
+	// the lease expired and was acquired by another replica meanwhile
+	if current.holder != election.communicator.identifier || current.token != token {
+		return
+	}
+	// the token is kept, so the next term gets a higher one
+	err = election.communicator.Storage.setLeaseIfVersion(ctx, election.name, lease{holder: election.communicator.identifier, token: token}, version)
+	if err != nil && !errors.Is(err, ErrConflict) {
+		logger.Warnw("could not release lease", "election", election.name, "error", err)
+	}
+}
+
+func (election *Election) setLeader(leader bool, token uint64) {
+	election.mutex.Lock()
+	if election.leader == leader && election.token == token {
+		election.mutex.Unlock()
+		return
+	}
+	election.leader = leader
+	election.token = token
+	handlers := make([]LeaderChangeHandler, len(election.handlers))
+	copy(handlers, election.handlers)
+	election.mutex.Unlock()
+
+	logger.Infow("leadership changed", "election", election.name, "leader", leader, "token", token)
+	for _, handler := range handlers {
+		handler(leader, token)
+	}
+}
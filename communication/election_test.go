@@ -0,0 +1,75 @@
+package communication_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+)
+
+func campaign(t *testing.T, election *communication.Election) context.CancelFunc {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- election.Campaign(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("campaign failed: %v", err)
+		}
+	})
+	return cancel
+}
+
+func TestElectionHasASingleLeader(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	storage := fake.NewStorage()
+	defer storage.Stop()
+	storageCommunicator, err := storage.Communicator()
+	if err != nil {
+		t.Fatalf("could not connect to storage: %v", err)
+	}
+	defer storageCommunicator.Close()
+
+	first := register(t, controlPlane, 9)
+	second := register(t, controlPlane, 10)
+	first.Storage = storageCommunicator
+	second.Storage = storageCommunicator
+	firstElection := first.NewElection("leader", 300*time.Millisecond)
+	secondElection := second.NewElection("leader", 300*time.Millisecond)
+
+	resignFirst := campaign(t, firstElection)
+	eventually(t, firstElection.IsLeader, "first replica did not become leader")
+	campaign(t, secondElection)
+	time.Sleep(200 * time.Millisecond)
+	if secondElection.IsLeader() {
+		t.Fatal("second replica became leader while the lease was held")
+	}
+
+	token := firstElection.Token()
+	resignFirst()
+	eventually(t, secondElection.IsLeader, "second replica did not take over after the leader resigned")
+	if secondElection.Token() <= token {
+		t.Fatalf("fencing token did not increase: %d after %d", secondElection.Token(), token)
+	}
+
+	// leases do not show up as services
+	namespaces, err := storageCommunicator.GetNamespaces(context.Background())
+	if err != nil {
+		t.Fatalf("could not get namespaces: %v", err)
+	}
+	for _, namespace := range namespaces {
+		if namespace == communication.LeaseNamespace {
+			t.Fatal("lease namespace is listed")
+		}
+	}
+	if _, err := storageCommunicator.GetService(context.Background(), communication.LeaseNamespace, "leader"); !errors.Is(err, communication.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+}
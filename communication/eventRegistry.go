@@ -0,0 +1,108 @@
+package communication
+
+import (
+	"errors"
+	"sync"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+)
+
+var ErrInvalidEventData = errors.New("event data does not match event type")
+
+// Convert a grpc event into its typed representation
+// Encoding is done by Event.ToGrpcEvent
+type EventDecoder func(*protoCommon.Event) (Event, error)
+
+type EventHandler func(Event)
+
+var (
+	eventDecoders      = make(map[EventType]EventDecoder)
+	eventDecodersMutex sync.RWMutex
+)
+
+func init() {
+	RegisterEventType(StorageChangedEvent, decodeStorageChanged)
+	RegisterEventType(ConfigurationChangedEvent, decodeConfigurationChanged)
+	RegisterEventType(ClusterChangedEvent, decodeClusterChanged)
+	RegisterEventType(ComponentRegisteredEvent, decodeComponentEvent)
+	RegisterEventType(ComponentCrashedEvent, decodeComponentEvent)
+	RegisterEventType(ComponentDeregisteredEvent, decodeComponentEvent)
+	RegisterEventType(ComponentStatusEvent, decodeComponentEvent)
+}
+
+// Make an event type known to this library
+// Events of types without decoder are delivered as *RawEvent
+func RegisterEventType(eventType EventType, decoder EventDecoder) {
+	eventDecodersMutex.Lock()
+	defer eventDecodersMutex.Unlock()
+	eventDecoders[eventType] = decoder
+}
+
+func getEventDecoder(eventType EventType) (EventDecoder, bool) {
+	eventDecodersMutex.RLock()
+	defer eventDecodersMutex.RUnlock()
+	decoder, ok := eventDecoders[eventType]
+	return decoder, ok
+}
+
+// Decode event using the decoder registered for its type
+// The returned bool is false if there is no decoder, the event is returned as *RawEvent in this case
+func DecodeEvent(event *protoCommon.Event) (Event, bool, error) {
+	decoder, ok := getEventDecoder(EventType(event.Type))
+	if !ok {
+		return (*RawEvent)(event), false, nil
+	}
+	decoded, err := decoder(event)
+	return decoded, true, err
+}
+
+// RawEvent is an event of a type no decoder is registered for
+type RawEvent protoCommon.Event
+
+func (e *RawEvent) GetType() EventType {
+	return EventType(e.Type)
+}
+
+func (e *RawEvent) ToGrpcEvent() *protoCommon.Event {
+	return (*protoCommon.Event)(e)
+}
+
+func decodeStorageChanged(event *protoCommon.Event) (Event, error) {
+	sc := event.GetStorageChanged()
+	if sc == nil {
+		return nil, ErrInvalidEventData
+	}
+	return (*StorageChanged)(sc), nil
+}
+
+func decodeConfigurationChanged(event *protoCommon.Event) (Event, error) {
+	cc := event.GetConfigurationChanged()
+	if cc == nil {
+		return nil, ErrInvalidEventData
+	}
+	return (*ConfigurationChanged)(cc), nil
+}
+
+func decodeClusterChanged(event *protoCommon.Event) (Event, error) {
+	cc := event.GetClusterChanged()
+	if cc == nil {
+		return nil, ErrInvalidEventData
+	}
+	return (*ClusterChanged)(cc), nil
+}
+
+func decodeComponentEvent(event *protoCommon.Event) (Event, error) {
+	resource := event.GetConfigurationChanged().GetResource()
+	if resource == nil || resource.Type != ComponentResourceType {
+		return nil, ErrInvalidEventData
+	}
+	component, details, err := decodeComponentDetails(resource)
+	if err != nil {
+		return nil, err
+	}
+	return &ComponentEvent{
+		Type:      EventType(event.Type),
+		Component: component,
+		Details:   details,
+	}, nil
+}
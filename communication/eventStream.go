@@ -0,0 +1,162 @@
+package communication
+
+import (
+	"context"
+	"io"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoControlPlane "github.com/kulycloud/protocol/control-plane"
+)
+
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connected
+	Reconnecting
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	default:
+		return "disconnected"
+	}
+}
+
+type ConnectionStateHandler func(ConnectionState)
+
+// add handler that is called every time the state of the event stream to the control plane changes
+func (communicator *ControlPlaneCommunicator) RegisterConnectionStateHandler(handler ConnectionStateHandler) {
+	communicator.connectionStateMutex.Lock()
+	defer communicator.connectionStateMutex.Unlock()
+	communicator.connectionStateHandlers = append(communicator.connectionStateHandlers, handler)
+}
+
+func (communicator *ControlPlaneCommunicator) ConnectionState() ConnectionState {
+	communicator.connectionStateMutex.Lock()
+	defer communicator.connectionStateMutex.Unlock()
+	return communicator.connectionState
+}
+
+func (communicator *ControlPlaneCommunicator) setConnectionState(state ConnectionState) {
+	communicator.connectionStateMutex.Lock()
+	if communicator.connectionState == state {
+		communicator.connectionStateMutex.Unlock()
+		return
+	}
+	communicator.connectionState = state
+	handlers := make([]ConnectionStateHandler, len(communicator.connectionStateHandlers))
+	copy(handlers, communicator.connectionStateHandlers)
+	communicator.connectionStateMutex.Unlock()
+
+	logger.Infow("control plane connection state changed", "state", state.String())
+	for _, handler := range handlers {
+		handler(state)
+	}
+}
+
+// register at the control plane and wait for the stream to be created
+func (communicator *ControlPlaneCommunicator) openEventStream(ctx context.Context, typeName string, endpoint *protoCommon.Endpoint) (protoControlPlane.ControlPlane_RegisterComponentClient, error) {
+	stream, err := communicator.controlPlaneClient.RegisterComponent(ctx, &protoControlPlane.RegisterComponentRequest{
+		Type:     typeName,
+		Endpoint: endpoint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// validate the stream has been created
+	_, err = stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	// announce this component to others discovering its type
+	event := NewComponentRegistered(typeName, NewIdentifierFromEndpoint(endpoint))
+	if _, err := communicator.controlPlaneClient.CreateEvent(ctx, event.ToGrpcEvent()); err != nil {
+		logger.Warnw("could not announce registration", "error", err)
+	}
+	return stream, nil
+}
+
+// process events until the stream breaks
+func (communicator *ControlPlaneCommunicator) receiveEvents(stream protoControlPlane.ControlPlane_RegisterComponentClient) {
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				logger.Warnw("could not receive data from stream", "error", err)
+			}
+			return
+		}
+		communicator.processEvent(event)
+	}
+}
+
+// receive events and re-establish the stream whenever it breaks until ctx is done
+func (communicator *ControlPlaneCommunicator) superviseEventStream(ctx context.Context, typeName string, endpoint *protoCommon.Endpoint, stream protoControlPlane.ControlPlane_RegisterComponentClient) {
+	for {
+		communicator.receiveEvents(stream)
+		if ctx.Err() != nil {
+			break
+		}
+
+		logger.Info("event stream closed, reconnecting")
+		communicator.setConnectionState(Reconnecting)
+		stream = communicator.reconnectEventStream(ctx, typeName, endpoint)
+		if stream == nil {
+			break
+		}
+		communicator.setConnectionState(Connected)
+	}
+
+	logger.Info("event stream closed")
+	communicator.setConnectionState(Disconnected)
+}
+
+// register again and listen to all event types handlers are registered for
+// returns nil if the reconnect policy gives up or ctx is done before the stream could be re-established
+func (communicator *ControlPlaneCommunicator) reconnectEventStream(ctx context.Context, typeName string, endpoint *protoCommon.Endpoint) protoControlPlane.ControlPlane_RegisterComponentClient {
+	var stream protoControlPlane.ControlPlane_RegisterComponentClient
+	err := communicator.reconnectPolicy.Retry(ctx, func() error {
+		// cancelling the context of the stream is the only way to end a registration
+		// do not keep one around that does not receive the events we need
+		streamCtx, cancel := context.WithCancel(ctx)
+		var err error
+		stream, err = communicator.openEventStream(streamCtx, typeName, endpoint)
+		if err == nil {
+			err = communicator.listenToRegisteredEvents(ctx)
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		if communicator.cancelEventStream != nil {
+			communicator.cancelEventStream()
+		}
+		communicator.cancelEventStream = cancel
+		return nil
+	})
+	if err != nil {
+		logger.Warnw("could not re-establish event stream", "error", err)
+		return nil
+	}
+
+	logger.Info("re-established event stream")
+	return stream
+}
+
+func (communicator *ControlPlaneCommunicator) listenToRegisteredEvents(ctx context.Context) error {
+	for _, eventType := range communicator.registeredEventTypes() {
+		request := newListenToEventRequest(communicator.identifier, eventType)
+		_, err := communicator.controlPlaneClient.ListenToEvent(ctx, request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
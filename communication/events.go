@@ -2,6 +2,10 @@ package communication
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
 	protoCommon "github.com/kulycloud/protocol/common"
 	protoControlPlane "github.com/kulycloud/protocol/control-plane"
 )
@@ -9,11 +13,38 @@ import (
 type EventType string
 
 const (
-	StorageChangedEvent       EventType = "storageChanged"
-	ConfigurationChangedEvent EventType = "configurationChanged"
-	ClusterChangedEvent       EventType = "clusterChanged"
+	StorageChangedEvent        EventType = "storageChanged"
+	ConfigurationChangedEvent  EventType = "configurationChanged"
+	ClusterChangedEvent        EventType = "clusterChanged"
+	ComponentRegisteredEvent   EventType = "componentRegistered"
+	ComponentCrashedEvent      EventType = "componentCrashed"
+	ComponentDeregisteredEvent EventType = "componentDeregistered"
+	ComponentStatusEvent       EventType = "componentStatus"
+	StopListeningToEventEvent  EventType = "stopListeningToEvent"
+)
+
+// resource type used to describe components in component events
+const ComponentResourceType = "component"
+
+// separates the identifier of a component from the details of a component event in the resource name
+const componentDetailsSeparator = "?"
+
+const (
+	crashReasonDetail    = "reason"
+	crashStackDetail     = "stack"
+	crashRecoveredDetail = "recovered"
+
+	statusHealthyDetail  = "healthy"
+	statusReadyDetail    = "ready"
+	statusInFlightDetail = "inFlight"
+	statusVersionDetail  = "version"
+	// load figures are sent as one detail per key
+	statusLoadDetailPrefix = "load."
 )
 
+// stacks are truncated to this size, as they are sent along with the crash event
+const maxCrashStackSize = 16 << 10
+
 type Event interface {
 	GetType() EventType
 	ToGrpcEvent() *protoCommon.Event
@@ -84,6 +115,138 @@ func (e *ClusterChanged) ToGrpcEvent() *protoCommon.Event {
 	}
 }
 
+// ComponentEvent describes a lifecycle change of a single component
+// The protocol has no dedicated payload for it, so the component is transmitted as resource:
+// the namespace holds the type of the component and the name its identifier.
+// Details are appended to the name as query string, so they are relayed by the control plane like the rest of the event.
+type ComponentEvent struct {
+	Type      EventType
+	Component *protoCommon.Resource
+	// e.g. the reason of a crash or the reported status
+	Details map[string]string
+}
+
+func NewComponentRegistered(typeName string, identifier string) *ComponentEvent {
+	return &ComponentEvent{
+		Type:      ComponentRegisteredEvent,
+		Component: NewResource(ComponentResourceType, typeName, identifier),
+	}
+}
+
+func NewComponentCrashed(typeName string, identifier string, crash Crash) *ComponentEvent {
+	stack := crash.Stack
+	if len(stack) > maxCrashStackSize {
+		stack = stack[:maxCrashStackSize]
+	}
+	return &ComponentEvent{
+		Type:      ComponentCrashedEvent,
+		Component: NewResource(ComponentResourceType, typeName, identifier),
+		Details: map[string]string{
+			crashReasonDetail:    crash.Reason,
+			crashStackDetail:     stack,
+			crashRecoveredDetail: strconv.FormatBool(crash.Recovered),
+		},
+	}
+}
+
+// Returns the crash described by a ComponentCrashed event, false for other events
+func (e *ComponentEvent) Crash() (Crash, bool) {
+	if e.Type != ComponentCrashedEvent {
+		return Crash{}, false
+	}
+	recovered, _ := strconv.ParseBool(e.Details[crashRecoveredDetail])
+	return Crash{
+		Reason:    e.Details[crashReasonDetail],
+		Stack:     e.Details[crashStackDetail],
+		Recovered: recovered,
+	}, true
+}
+
+func NewComponentDeregistered(typeName string, identifier string) *ComponentEvent {
+	return &ComponentEvent{
+		Type:      ComponentDeregisteredEvent,
+		Component: NewResource(ComponentResourceType, typeName, identifier),
+	}
+}
+
+func NewComponentStatus(typeName string, identifier string, status *Status) *ComponentEvent {
+	details := map[string]string{
+		statusHealthyDetail:  strconv.FormatBool(status.Healthy),
+		statusReadyDetail:    strconv.FormatBool(status.Ready),
+		statusInFlightDetail: strconv.FormatInt(status.InFlightRequests, 10),
+		statusVersionDetail:  status.Version,
+	}
+	for key, value := range status.Load {
+		details[statusLoadDetailPrefix+key] = value
+	}
+	return &ComponentEvent{
+		Type:      ComponentStatusEvent,
+		Component: NewResource(ComponentResourceType, typeName, identifier),
+		Details:   details,
+	}
+}
+
+// Returns the status reported by a ComponentStatus event, false for other events
+func (e *ComponentEvent) Status() (*Status, bool) {
+	if e.Type != ComponentStatusEvent {
+		return nil, false
+	}
+	healthy, _ := strconv.ParseBool(e.Details[statusHealthyDetail])
+	ready, _ := strconv.ParseBool(e.Details[statusReadyDetail])
+	inFlight, _ := strconv.ParseInt(e.Details[statusInFlightDetail], 10, 64)
+	status := &Status{
+		Healthy:          healthy,
+		Ready:            ready,
+		InFlightRequests: inFlight,
+		Version:          e.Details[statusVersionDetail],
+		Load:             make(map[string]string),
+	}
+	for key, value := range e.Details {
+		if strings.HasPrefix(key, statusLoadDetailPrefix) {
+			status.Load[strings.TrimPrefix(key, statusLoadDetailPrefix)] = value
+		}
+	}
+	return status, true
+}
+
+func (e *ComponentEvent) GetType() EventType {
+	return e.Type
+}
+
+func (e *ComponentEvent) ToGrpcEvent() *protoCommon.Event {
+	resource := e.Component
+	if len(e.Details) > 0 {
+		values := make(url.Values, len(e.Details))
+		for key, value := range e.Details {
+			values.Set(key, value)
+		}
+		resource = NewResource(e.Component.Type, e.Component.Namespace, e.Component.Name+componentDetailsSeparator+values.Encode())
+	}
+	return &protoCommon.Event{
+		Type: string(e.Type),
+		Data: &protoCommon.Event_ConfigurationChanged{
+			ConfigurationChanged: &protoCommon.ConfigurationChangedEvent{Resource: resource},
+		},
+	}
+}
+
+// split the resource name into the identifier and the details of the event
+func decodeComponentDetails(resource *protoCommon.Resource) (*protoCommon.Resource, map[string]string, error) {
+	separator := strings.Index(resource.Name, componentDetailsSeparator)
+	if separator < 0 {
+		return resource, nil, nil
+	}
+	values, err := url.ParseQuery(resource.Name[separator+1:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidEventData, err)
+	}
+	details := make(map[string]string, len(values))
+	for key := range values {
+		details[key] = values.Get(key)
+	}
+	return NewResource(resource.Type, resource.Namespace, resource.Name[:separator]), details, nil
+}
+
 type (
 	StorageChangedHandler       func(*StorageChanged)
 	ConfigurationChangedHandler func(*ConfigurationChanged)
@@ -112,6 +275,19 @@ func newListenToEventRequest(identifier string, eventType EventType) *protoContr
 	}
 }
 
+// The protocol has no counterpart to ListenToEvent, so stopping is requested with an event
+// carrying the event type and the destination as resource
+func newStopListeningToEvent(identifier string, eventType EventType) *protoCommon.Event {
+	return &protoCommon.Event{
+		Type: string(StopListeningToEventEvent),
+		Data: &protoCommon.Event_ConfigurationChanged{
+			ConfigurationChanged: &protoCommon.ConfigurationChangedEvent{
+				Resource: NewResource(string(eventType), "", identifier),
+			},
+		},
+	}
+}
+
 func NewIdentifierFromEndpoint(endpoint *protoCommon.Endpoint) string {
 	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
 }
@@ -0,0 +1,12 @@
+package communication
+
+import "time"
+
+// shortens the interval unhealthy storage endpoints are probed in, returns a function restoring it
+func SetStorageProbeInterval(interval time.Duration) func() {
+	previous := storageProbeInterval
+	storageProbeInterval = interval
+	return func() {
+		storageProbeInterval = previous
+	}
+}
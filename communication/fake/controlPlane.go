@@ -0,0 +1,233 @@
+// Package fake provides in-memory implementations of kulycloud components for tests
+package fake
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/security"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoControlPlane "github.com/kulycloud/protocol/control-plane"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufferSize = 1 << 20
+
+var ErrComponentNotRegistered = errors.New("component not registered")
+
+var _ protoControlPlane.ControlPlaneServer = &ControlPlane{}
+
+// ControlPlane is an in-memory control plane served over bufconn
+// It forwards created events to all components listening to their type, just like the real control plane
+type ControlPlane struct {
+	protoControlPlane.UnimplementedControlPlaneServer
+	listener *bufconn.Listener
+	server   *grpc.Server
+
+	mutex         sync.Mutex
+	components    map[string]*registeredComponent
+	createdEvents []*protoCommon.Event
+}
+
+type registeredComponent struct {
+	typeName string
+	endpoint *protoCommon.Endpoint
+	listens  map[communication.EventType]bool
+	events   chan *protoCommon.Event
+	done     chan struct{}
+}
+
+// RegisteredComponent describes a component with an open event stream
+type RegisteredComponent struct {
+	Type       string
+	Identifier string
+	Endpoint   *protoCommon.Endpoint
+	Listens    []communication.EventType
+}
+
+// Create and start a control plane, it has to be stopped by calling Stop
+func NewControlPlane() *ControlPlane {
+	controlPlane := &ControlPlane{
+		listener:   bufconn.Listen(bufferSize),
+		server:     grpc.NewServer(),
+		components: make(map[string]*registeredComponent),
+	}
+	protoControlPlane.RegisterControlPlaneServer(controlPlane.server, controlPlane)
+	go func() {
+		_ = controlPlane.server.Serve(controlPlane.listener)
+	}()
+	return controlPlane
+}
+
+func (controlPlane *ControlPlane) Stop() {
+	controlPlane.server.Stop()
+}
+
+// Options to connect to this control plane, the host and port passed along are ignored
+func (controlPlane *ControlPlane) RegisterOptions() []communication.RegisterOption {
+	return []communication.RegisterOption{
+		communication.WithTransport(security.Insecure()),
+		communication.WithDialOptions(controlPlane.DialOption()),
+	}
+}
+
+func (controlPlane *ControlPlane) DialOption() grpc.DialOption {
+	return grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return controlPlane.listener.Dial()
+	})
+}
+
+// Register a component at this control plane
+func (controlPlane *ControlPlane) Register(ctx context.Context, typeName string, host string, port uint32, withStorage bool, opts ...communication.RegisterOption) (*communication.ControlPlaneCommunicator, error) {
+	return communication.RegisterToControlPlaneContext(ctx, typeName, host, port, "fake", 0, withStorage, append(controlPlane.RegisterOptions(), opts...)...)
+}
+
+func (controlPlane *ControlPlane) RegisterComponent(request *protoControlPlane.RegisterComponentRequest, stream protoControlPlane.ControlPlane_RegisterComponentServer) error {
+	identifier := communication.NewIdentifierFromEndpoint(request.Endpoint)
+	component := &registeredComponent{
+		typeName: request.Type,
+		endpoint: request.Endpoint,
+		listens:  make(map[communication.EventType]bool),
+		events:   make(chan *protoCommon.Event, 1024),
+		done:     make(chan struct{}),
+	}
+
+	controlPlane.mutex.Lock()
+	if previous, ok := controlPlane.components[identifier]; ok {
+		close(previous.done)
+	}
+	controlPlane.components[identifier] = component
+	controlPlane.mutex.Unlock()
+
+	defer func() {
+		controlPlane.mutex.Lock()
+		if controlPlane.components[identifier] == component {
+			delete(controlPlane.components, identifier)
+		}
+		controlPlane.mutex.Unlock()
+	}()
+
+	// the first message confirms the registration
+	if err := stream.Send(&protoCommon.Event{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event := <-component.events:
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-component.done:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (controlPlane *ControlPlane) CreateEvent(_ context.Context, event *protoCommon.Event) (*protoCommon.Empty, error) {
+	controlPlane.mutex.Lock()
+	controlPlane.createdEvents = append(controlPlane.createdEvents, event)
+	if eventType(event) == communication.StopListeningToEventEvent {
+		resource := event.GetConfigurationChanged().GetResource()
+		if component, ok := controlPlane.components[resource.GetName()]; ok {
+			delete(component.listens, communication.EventType(resource.GetType()))
+		}
+	}
+	controlPlane.mutex.Unlock()
+
+	controlPlane.Push(event)
+	return &protoCommon.Empty{}, nil
+}
+
+func (controlPlane *ControlPlane) ListenToEvent(_ context.Context, request *protoControlPlane.ListenToEventRequest) (*protoCommon.Empty, error) {
+	controlPlane.mutex.Lock()
+	defer controlPlane.mutex.Unlock()
+	component, ok := controlPlane.components[request.Destination]
+	if !ok {
+		return nil, ErrComponentNotRegistered
+	}
+	component.listens[communication.EventType(request.Type)] = true
+	return &protoCommon.Empty{}, nil
+}
+
+// Send event to all components listening to its type
+func (controlPlane *ControlPlane) Push(event *protoCommon.Event) {
+	controlPlane.mutex.Lock()
+	defer controlPlane.mutex.Unlock()
+	for _, component := range controlPlane.components {
+		if component.listens[eventType(event)] {
+			component.send(event)
+		}
+	}
+}
+
+// Send event to a single component regardless of the event types it listens to
+func (controlPlane *ControlPlane) PushTo(identifier string, event *protoCommon.Event) error {
+	controlPlane.mutex.Lock()
+	defer controlPlane.mutex.Unlock()
+	component, ok := controlPlane.components[identifier]
+	if !ok {
+		return ErrComponentNotRegistered
+	}
+	component.send(event)
+	return nil
+}
+
+// Close the event stream of a component, it is expected to reconnect
+func (controlPlane *ControlPlane) Disconnect(identifier string) error {
+	controlPlane.mutex.Lock()
+	defer controlPlane.mutex.Unlock()
+	component, ok := controlPlane.components[identifier]
+	if !ok {
+		return ErrComponentNotRegistered
+	}
+	close(component.done)
+	delete(controlPlane.components, identifier)
+	return nil
+}
+
+func (controlPlane *ControlPlane) Components() []RegisteredComponent {
+	controlPlane.mutex.Lock()
+	defer controlPlane.mutex.Unlock()
+	components := make([]RegisteredComponent, 0, len(controlPlane.components))
+	for identifier, component := range controlPlane.components {
+		listens := make([]communication.EventType, 0, len(component.listens))
+		for listened := range component.listens {
+			listens = append(listens, listened)
+		}
+		components = append(components, RegisteredComponent{
+			Type:       component.typeName,
+			Identifier: identifier,
+			Endpoint:   component.endpoint,
+			Listens:    listens,
+		})
+	}
+	return components
+}
+
+// Events created by components in the order they were received
+func (controlPlane *ControlPlane) CreatedEvents() []*protoCommon.Event {
+	controlPlane.mutex.Lock()
+	defer controlPlane.mutex.Unlock()
+	events := make([]*protoCommon.Event, len(controlPlane.createdEvents))
+	copy(events, controlPlane.createdEvents)
+	return events
+}
+
+func eventType(event *protoCommon.Event) communication.EventType {
+	return communication.EventType(event.Type)
+}
+
+// must be called while holding the mutex, drops the event if the component does not keep up
+func (component *registeredComponent) send(event *protoCommon.Event) {
+	select {
+	case component.events <- event:
+	default:
+	}
+}
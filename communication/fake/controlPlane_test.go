@@ -0,0 +1,195 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+	protoCommon "github.com/kulycloud/protocol/common"
+)
+
+const waitTimeout = 5 * time.Second
+
+func register(t *testing.T, controlPlane *fake.ControlPlane, typeName string, port uint32, opts ...communication.RegisterOption) *communication.ControlPlaneCommunicator {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	communicator, err := controlPlane.Register(ctx, typeName, "localhost", port, false, opts...)
+	if err != nil {
+		t.Fatalf("could not register: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = communicator.Close(context.Background())
+	})
+	return communicator
+}
+
+func eventually(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func component(controlPlane *fake.ControlPlane, identifier string) (fake.RegisteredComponent, bool) {
+	for _, component := range controlPlane.Components() {
+		if component.Identifier == identifier {
+			return component, true
+		}
+	}
+	return fake.RegisteredComponent{}, false
+}
+
+func listens(controlPlane *fake.ControlPlane, identifier string, eventType communication.EventType) bool {
+	component, ok := component(controlPlane, identifier)
+	if !ok {
+		return false
+	}
+	for _, listened := range component.Listens {
+		if listened == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func receive(t *testing.T, events <-chan *communication.ConfigurationChanged) *communication.ConfigurationChanged {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(waitTimeout):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func TestRegisterAnnouncesComponent(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, "loadbalancer", 1)
+
+	registered, ok := component(controlPlane, "localhost:1")
+	if !ok {
+		t.Fatal("component is not registered")
+	}
+	if registered.Type != "loadbalancer" || registered.Endpoint.GetHost() != "localhost" || registered.Endpoint.GetPort() != 1 {
+		t.Fatalf("unexpected component: %+v", registered)
+	}
+	if communicator.ConnectionState() != communication.Connected {
+		t.Fatalf("expected to be connected, got %s", communicator.ConnectionState())
+	}
+
+	announced := false
+	for _, event := range controlPlane.CreatedEvents() {
+		if communication.EventType(event.Type) == communication.ComponentRegisteredEvent {
+			announced = true
+		}
+	}
+	if !announced {
+		t.Fatal("registration was not announced")
+	}
+}
+
+func TestEventsAreForwardedToListeningComponents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	listener := register(t, controlPlane, "loadbalancer", 1)
+	creator := register(t, controlPlane, "control-plane-client", 2)
+
+	received := make(chan *communication.ConfigurationChanged, 16)
+	if _, err := listener.RegisterConfigurationChangedHandler(func(event *communication.ConfigurationChanged) {
+		received <- event
+	}); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	if !listens(controlPlane, "localhost:1", communication.ConfigurationChangedEvent) {
+		t.Fatal("subscribing did not listen to the event type")
+	}
+
+	if err := creator.CreateEvent(communication.NewConfigurationChanged(communication.NewResource("route", "default", "created"))); err != nil {
+		t.Fatalf("could not create event: %v", err)
+	}
+	if event := receive(t, received); event.Resource.Name != "created" {
+		t.Fatalf("unexpected event: %+v", event.Resource)
+	}
+
+	controlPlane.Push(communication.NewConfigurationChanged(communication.NewResource("route", "default", "pushed")).ToGrpcEvent())
+	if event := receive(t, received); event.Resource.Name != "pushed" {
+		t.Fatalf("unexpected event: %+v", event.Resource)
+	}
+
+	if err := controlPlane.PushTo("localhost:1", communication.NewConfigurationChanged(communication.NewResource("route", "default", "direct")).ToGrpcEvent()); err != nil {
+		t.Fatalf("could not push event: %v", err)
+	}
+	if event := receive(t, received); event.Resource.Name != "direct" {
+		t.Fatalf("unexpected event: %+v", event.Resource)
+	}
+
+	// the creator did not subscribe, so events must not be forwarded to it
+	if listens(controlPlane, "localhost:2", communication.ConfigurationChangedEvent) {
+		t.Fatal("component listens to an event type it did not subscribe to")
+	}
+}
+
+func TestReconnectRestoresListenedEvents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, "loadbalancer", 1, communication.WithReconnectPolicy(communication.RetryPolicy{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     100 * time.Millisecond,
+		Multiplier:      2,
+	}))
+
+	states := make(chan communication.ConnectionState, 16)
+	communicator.RegisterConnectionStateHandler(func(state communication.ConnectionState) {
+		states <- state
+	})
+	received := make(chan *communication.ConfigurationChanged, 16)
+	if _, err := communicator.RegisterConfigurationChangedHandler(func(event *communication.ConfigurationChanged) {
+		received <- event
+	}); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	if err := controlPlane.Disconnect("localhost:1"); err != nil {
+		t.Fatalf("could not disconnect: %v", err)
+	}
+	for _, expected := range []communication.ConnectionState{communication.Reconnecting, communication.Connected} {
+		select {
+		case state := <-states:
+			if state != expected {
+				t.Fatalf("expected state %s, got %s", expected, state)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("state did not change to %s", expected)
+		}
+	}
+	eventually(t, func() bool {
+		return listens(controlPlane, "localhost:1", communication.ConfigurationChangedEvent)
+	}, "listened event types were not restored after reconnecting")
+
+	controlPlane.Push(communication.NewConfigurationChanged(communication.NewResource("route", "default", "after")).ToGrpcEvent())
+	if event := receive(t, received); event.Resource.Name != "after" {
+		t.Fatalf("unexpected event: %+v", event.Resource)
+	}
+}
+
+func TestUnknownComponents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+
+	if err := controlPlane.Disconnect("localhost:1"); !errors.Is(err, fake.ErrComponentNotRegistered) {
+		t.Fatalf("expected ErrComponentNotRegistered, got %v", err)
+	}
+	if err := controlPlane.PushTo("localhost:1", &protoCommon.Event{}); !errors.Is(err, fake.ErrComponentNotRegistered) {
+		t.Fatalf("expected ErrComponentNotRegistered, got %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+package fake
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/security"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ protoStorage.StorageServer = &Storage{}
+var _ protoCommon.ComponentServer = &Storage{}
+
+// Storage is an in-memory storage served over bufconn
+// It doubles as reference for the semantics expected from storage implementations:
+//   - resources are addressed by namespace and name, both must not be empty
+//   - routes get a UID when they are created, it is kept when they are updated
+//   - hosts identify the route a request starts with, so they are unique across routes
+//   - route steps are addressed by their index, references of a step point to other indices
+//   - LB endpoints are stored independently of services, unknown services have none
+//   - missing resources result in NotFound, invalid requests in InvalidArgument
+//   - writes carrying an expected version fail with Aborted if the stored resource has another one,
+//     see communication.ExpectedVersionFromContext
+type Storage struct {
+	protoStorage.UnimplementedStorageServer
+	protoCommon.UnimplementedComponentServer
+	listener *bufconn.Listener
+	server   *grpc.Server
+	// set if the storage listens on a network address as well
+	address net.Addr
+
+	mutex       sync.RWMutex
+	routes      map[namespacedName]*storedRoute
+	services    map[namespacedName]*protoStorage.Service
+	lbEndpoints map[namespacedName][]*protoCommon.Endpoint
+}
+
+type namespacedName struct {
+	namespace string
+	name      string
+}
+
+type storedRoute struct {
+	uid   string
+	name  namespacedName
+	route *protoStorage.Route
+}
+
+// Create and start a storage, it has to be stopped by calling Stop
+func NewStorage() *Storage {
+	storage := &Storage{
+		listener:    bufconn.Listen(bufferSize),
+		server:      grpc.NewServer(),
+		routes:      make(map[namespacedName]*storedRoute),
+		services:    make(map[namespacedName]*protoStorage.Service),
+		lbEndpoints: make(map[namespacedName][]*protoCommon.Endpoint),
+	}
+	protoStorage.RegisterStorageServer(storage.server, storage)
+	protoCommon.RegisterComponentServer(storage.server, storage)
+	go func() {
+		_ = storage.server.Serve(storage.listener)
+	}()
+	return storage
+}
+
+// Create and start a storage that is reachable at address as well, e.g. "127.0.0.1:0"
+// Components can connect to it through Endpoint like to a real storage, it has to be stopped by calling Stop
+func NewStorageOnAddress(address string) (*Storage, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	storage := NewStorage()
+	storage.address = listener.Addr()
+	go func() {
+		_ = storage.server.Serve(listener)
+	}()
+	return storage, nil
+}
+
+// Endpoint the storage is reachable at, nil if it was not created by NewStorageOnAddress
+func (storage *Storage) Endpoint() *protoCommon.Endpoint {
+	address, ok := storage.address.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return &protoCommon.Endpoint{Host: address.IP.String(), Port: uint32(address.Port)}
+}
+
+func (storage *Storage) Stop() {
+	storage.server.Stop()
+}
+
+func (storage *Storage) DialOption() grpc.DialOption {
+	return grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return storage.listener.Dial()
+	})
+}
+
+// Create a communicator connected to this storage, it has to be closed by the caller
+// It is dialed like connections to real storages, so the default auth is applied as well
+func (storage *Storage) Communicator() (*communication.StorageCommunicator, error) {
+	conn, err := security.Dial("bufconn", security.Insecure(), storage.DialOption())
+	if err != nil {
+		return nil, err
+	}
+	return communication.NewStorageCommunicator(communication.NewComponentCommunicator(conn)), nil
+}
+
+func (storage *Storage) Ping(context.Context, *protoCommon.Empty) (*protoCommon.Empty, error) {
+	return &protoCommon.Empty{}, nil
+}
+
+func (storage *Storage) SetRoute(ctx context.Context, request *protoStorage.SetRouteRequest) (*protoStorage.SetRouteResponse, error) {
+	key, err := toKey(request.NamespacedName)
+	if err != nil {
+		return nil, err
+	}
+	if request.Data == nil {
+		return nil, status.Error(codes.InvalidArgument, "route must not be empty")
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	for otherKey, other := range storage.routes {
+		if otherKey != key && request.Data.Host != "" && other.route.Host == request.Data.Host {
+			return nil, status.Errorf(codes.AlreadyExists, "host %s is used by route %s/%s", request.Data.Host, otherKey.namespace, otherKey.name)
+		}
+	}
+
+	stored, ok := storage.routes[key]
+	currentVersion := communication.NoVersion
+	if ok {
+		currentVersion = communication.ResourceVersion(stored.route)
+	}
+	if err := checkVersion(ctx, currentVersion); err != nil {
+		return nil, err
+	}
+	if !ok {
+		stored = &storedRoute{uid: newUID(), name: key}
+		storage.routes[key] = stored
+	}
+	stored.route = proto.Clone(request.Data).(*protoStorage.Route)
+	return &protoStorage.SetRouteResponse{Uid: stored.uid}, nil
+}
+
+func (storage *Storage) GetRoute(_ context.Context, request *protoStorage.GetRouteRequest) (*protoStorage.GetRouteResponse, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	stored, err := storage.findRoute(request.GetNamespacedName(), request.GetUid())
+	if err != nil {
+		return nil, err
+	}
+	return &protoStorage.GetRouteResponse{Route: stored.withId()}, nil
+}
+
+func (storage *Storage) GetRouteStep(_ context.Context, request *protoStorage.GetRouteStepRequest) (*protoStorage.GetRouteStepResponse, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	stored, err := storage.findRoute(request.GetNamespacedName(), request.GetUid())
+	if err != nil {
+		return nil, err
+	}
+	step, err := stored.step(request.StepId)
+	if err != nil {
+		return nil, err
+	}
+	return &protoStorage.GetRouteStepResponse{Step: proto.Clone(step).(*protoStorage.RouteStep)}, nil
+}
+
+func (storage *Storage) GetPopulatedRouteStep(_ context.Context, request *protoStorage.GetRouteStepRequest) (*protoStorage.GetPopulatedRouteStepResponse, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	stored, err := storage.findRoute(request.GetNamespacedName(), request.GetUid())
+	if err != nil {
+		return nil, err
+	}
+	step, err := stored.step(request.StepId)
+	if err != nil {
+		return nil, err
+	}
+	// the response must not share anything with the stored route
+	step = proto.Clone(step).(*protoStorage.RouteStep)
+
+	populated := &protoStorage.PopulatedRouteStep{
+		Config:     step.Config,
+		Name:       step.Name,
+		Service:    step.Service,
+		References: make(map[string]*protoStorage.PopulatedRouteStepReference, len(step.References)),
+	}
+	for reference, stepId := range step.References {
+		referenced, err := stored.step(stepId)
+		if err != nil {
+			return nil, err
+		}
+		populated.References[reference] = storage.populateReference(stepId, referenced)
+	}
+	return &protoStorage.GetPopulatedRouteStepResponse{Step: populated}, nil
+}
+
+func (storage *Storage) GetRouteStart(_ context.Context, request *protoStorage.GetRouteStartRequest) (*protoStorage.GetRouteStartResponse, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	for _, stored := range storage.routes {
+		if stored.route.Host != request.Host {
+			continue
+		}
+		step, err := stored.step(0)
+		if err != nil {
+			return nil, err
+		}
+		return &protoStorage.GetRouteStartResponse{Uid: stored.uid, Step: storage.populateReference(0, step)}, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "no route for host %s", request.Host)
+}
+
+func (storage *Storage) GetRoutesInNamespace(_ context.Context, request *protoStorage.GetRoutesInNamespaceRequest) (*protoStorage.GetRoutesInNamespaceResponse, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	uids := make([]string, 0)
+	for key, stored := range storage.routes {
+		if key.namespace == request.Namespace {
+			uids = append(uids, stored.uid)
+		}
+	}
+	sort.Strings(uids)
+	return &protoStorage.GetRoutesInNamespaceResponse{RouteUids: uids}, nil
+}
+
+func (storage *Storage) DeleteRoute(_ context.Context, request *protoStorage.DeleteRouteRequest) (*protoCommon.Empty, error) {
+	key, err := toKey(request.NamespacedName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if _, ok := storage.routes[key]; !ok {
+		return nil, notFound("route", key)
+	}
+	delete(storage.routes, key)
+	return &protoCommon.Empty{}, nil
+}
+
+func (storage *Storage) SetService(ctx context.Context, request *protoStorage.SetServiceRequest) (*protoCommon.Empty, error) {
+	key, err := toKey(request.NamespacedName)
+	if err != nil {
+		return nil, err
+	}
+	if request.Service == nil {
+		return nil, status.Error(codes.InvalidArgument, "service must not be empty")
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	currentVersion := communication.NoVersion
+	if current, ok := storage.services[key]; ok {
+		currentVersion = communication.ResourceVersion(current)
+	}
+	if err := checkVersion(ctx, currentVersion); err != nil {
+		return nil, err
+	}
+	storage.services[key] = proto.Clone(request.Service).(*protoStorage.Service)
+	return &protoCommon.Empty{}, nil
+}
+
+func (storage *Storage) GetService(_ context.Context, request *protoStorage.GetServiceRequest) (*protoStorage.GetServiceResponse, error) {
+	key, err := toKey(request.NamespacedName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	service, ok := storage.services[key]
+	if !ok {
+		return nil, notFound("service", key)
+	}
+	return &protoStorage.GetServiceResponse{Service: proto.Clone(service).(*protoStorage.Service)}, nil
+}
+
+func (storage *Storage) GetServicesInNamespace(_ context.Context, request *protoStorage.GetServicesInNamespaceRequest) (*protoStorage.GetServicesInNamespaceResponse, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	names := make([]string, 0)
+	for key := range storage.services {
+		if key.namespace == request.Namespace {
+			names = append(names, key.name)
+		}
+	}
+	sort.Strings(names)
+	return &protoStorage.GetServicesInNamespaceResponse{Names: names}, nil
+}
+
+func (storage *Storage) DeleteService(_ context.Context, request *protoStorage.DeleteServiceRequest) (*protoCommon.Empty, error) {
+	key, err := toKey(request.NamespacedName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if _, ok := storage.services[key]; !ok {
+		return nil, notFound("service", key)
+	}
+	delete(storage.services, key)
+	delete(storage.lbEndpoints, key)
+	return &protoCommon.Empty{}, nil
+}
+
+func (storage *Storage) GetServiceLBEndpoints(_ context.Context, request *protoStorage.NamespacedName) (*protoCommon.EndpointList, error) {
+	key, err := toKey(request)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	return &protoCommon.EndpointList{Endpoints: cloneEndpoints(storage.lbEndpoints[key])}, nil
+}
+
+func (storage *Storage) SetServiceLBEndpoints(ctx context.Context, request *protoStorage.SetServiceLBEndpointsRequest) (*protoCommon.Empty, error) {
+	key, err := toKey(request.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if err := checkVersion(ctx, communication.EndpointsVersion(storage.lbEndpoints[key])); err != nil {
+		return nil, err
+	}
+	storage.lbEndpoints[key] = cloneEndpoints(request.Endpoints)
+	return &protoCommon.Empty{}, nil
+}
+
+func (storage *Storage) GetNamespaces(context.Context, *protoCommon.Empty) (*protoStorage.NamespaceList, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	unique := make(map[string]bool)
+	for key := range storage.routes {
+		unique[key.namespace] = true
+	}
+	for key := range storage.services {
+		unique[key.namespace] = true
+	}
+
+	namespaces := make([]string, 0, len(unique))
+	for namespace := range unique {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return &protoStorage.NamespaceList{Namespaces: namespaces}, nil
+}
+
+// has to be called while holding the mutex
+func (storage *Storage) findRoute(name *protoStorage.NamespacedName, uid string) (*storedRoute, error) {
+	if name == nil {
+		for _, stored := range storage.routes {
+			if stored.uid == uid {
+				return stored, nil
+			}
+		}
+		return nil, status.Errorf(codes.NotFound, "route %s not found", uid)
+	}
+
+	key, err := toKey(name)
+	if err != nil {
+		return nil, err
+	}
+	stored, ok := storage.routes[key]
+	if !ok {
+		return nil, notFound("route", key)
+	}
+	return stored, nil
+}
+
+// has to be called while holding the mutex
+func (storage *Storage) populateReference(stepId uint32, step *protoStorage.RouteStep) *protoStorage.PopulatedRouteStepReference {
+	var endpoints []*protoCommon.Endpoint
+	if step.Service != nil {
+		endpoints = storage.lbEndpoints[namespacedName{namespace: step.Service.Namespace, name: step.Service.Name}]
+	}
+	return &protoStorage.PopulatedRouteStepReference{Step: stepId, Endpoints: cloneEndpoints(endpoints)}
+}
+
+func (stored *storedRoute) withId() *protoStorage.RouteWithId {
+	return &protoStorage.RouteWithId{
+		Uid:   stored.uid,
+		Route: proto.Clone(stored.route).(*protoStorage.Route),
+		Name:  &protoStorage.NamespacedName{Namespace: stored.name.namespace, Name: stored.name.name},
+	}
+}
+
+func (stored *storedRoute) step(stepId uint32) (*protoStorage.RouteStep, error) {
+	if int(stepId) >= len(stored.route.Steps) {
+		return nil, status.Errorf(codes.NotFound, "route %s has no step %d", stored.uid, stepId)
+	}
+	return stored.route.Steps[stepId], nil
+}
+
+func checkVersion(ctx context.Context, current string) error {
+	expected, ok := communication.ExpectedVersionFromContext(ctx)
+	if ok && expected != current {
+		return status.Errorf(codes.Aborted, "expected version %q, found %q", expected, current)
+	}
+	return nil
+}
+
+func toKey(name *protoStorage.NamespacedName) (namespacedName, error) {
+	if name.GetNamespace() == "" || name.GetName() == "" {
+		return namespacedName{}, status.Error(codes.InvalidArgument, "namespace and name must not be empty")
+	}
+	return namespacedName{namespace: name.Namespace, name: name.Name}, nil
+}
+
+func notFound(resourceType string, key namespacedName) error {
+	return status.Errorf(codes.NotFound, "%s %s/%s not found", resourceType, key.namespace, key.name)
+}
+
+func cloneEndpoints(endpoints []*protoCommon.Endpoint) []*protoCommon.Endpoint {
+	cloned := make([]*protoCommon.Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		cloned = append(cloned, proto.Clone(endpoint).(*protoCommon.Endpoint))
+	}
+	return cloned
+}
+
+func newUID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,223 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+)
+
+func newStorage(t *testing.T) *communication.StorageCommunicator {
+	t.Helper()
+	storage := fake.NewStorage()
+	t.Cleanup(storage.Stop)
+	communicator, err := storage.Communicator()
+	if err != nil {
+		t.Fatalf("could not connect to storage: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = communicator.Close()
+	})
+	return communicator
+}
+
+func exampleRoute(host string) *protoStorage.Route {
+	return &protoStorage.Route{
+		Host: host,
+		Steps: []*protoStorage.RouteStep{
+			{Name: "start", Config: "{}", References: map[string]uint32{"next": 1}},
+			{Name: "backend", Config: "{}", Service: &protoStorage.NamespacedName{Namespace: "default", Name: "backend"}},
+		},
+	}
+}
+
+func TestRoutesKeepTheirUID(t *testing.T) {
+	storage := newStorage(t)
+	ctx := context.Background()
+
+	uid, err := storage.SetRouteByNamespacedName(ctx, "default", "example", exampleRoute("example.com"))
+	if err != nil {
+		t.Fatalf("could not set route: %v", err)
+	}
+	updated, err := storage.SetRouteByNamespacedName(ctx, "default", "example", exampleRoute("example.org"))
+	if err != nil {
+		t.Fatalf("could not update route: %v", err)
+	}
+	if updated != uid {
+		t.Fatalf("UID changed from %s to %s", uid, updated)
+	}
+
+	route, err := storage.GetRouteByUID(ctx, uid)
+	if err != nil {
+		t.Fatalf("could not get route: %v", err)
+	}
+	if route.Route.Host != "example.org" || route.Name.Namespace != "default" || route.Name.Name != "example" {
+		t.Fatalf("unexpected route: %v", route)
+	}
+
+	uids, err := storage.GetRoutesInNamespace(ctx, "default")
+	if err != nil || len(uids) != 1 || uids[0] != uid {
+		t.Fatalf("unexpected routes in namespace: %v, %v", uids, err)
+	}
+}
+
+func TestHostsAreUniqueAcrossRoutes(t *testing.T) {
+	storage := newStorage(t)
+	ctx := context.Background()
+
+	if _, err := storage.SetRouteByNamespacedName(ctx, "default", "first", exampleRoute("example.com")); err != nil {
+		t.Fatalf("could not set route: %v", err)
+	}
+	_, err := storage.SetRouteByNamespacedName(ctx, "other", "second", exampleRoute("example.com"))
+	if !errors.Is(err, communication.ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+}
+
+func TestPopulatedStepsContainReferencedEndpoints(t *testing.T) {
+	storage := newStorage(t)
+	ctx := context.Background()
+
+	uid, err := storage.SetRouteByNamespacedName(ctx, "default", "example", exampleRoute("example.com"))
+	if err != nil {
+		t.Fatalf("could not set route: %v", err)
+	}
+	endpoints := []*protoCommon.Endpoint{{Host: "backend", Port: 8080}}
+	if err := storage.SetServiceLBEndpoints(ctx, "default", "backend", endpoints); err != nil {
+		t.Fatalf("could not set endpoints: %v", err)
+	}
+
+	start, err := storage.GetRouteStart(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("could not get route start: %v", err)
+	}
+	if start.Uid != uid || start.Step.Step != 0 {
+		t.Fatalf("unexpected route start: %v", start)
+	}
+
+	step, err := storage.GetPopulatedRouteStepByUID(ctx, uid, 0)
+	if err != nil {
+		t.Fatalf("could not get populated step: %v", err)
+	}
+	next := step.References["next"]
+	if step.Name != "start" || next.GetStep() != 1 || len(next.GetEndpoints()) != 1 || next.Endpoints[0].Port != 8080 {
+		t.Fatalf("unexpected populated step: %v", step)
+	}
+
+	// responses must not share anything with the stored route
+	backend, err := storage.GetPopulatedRouteStepByNamespacedName(ctx, "default", "example", 1)
+	if err != nil {
+		t.Fatalf("could not get populated step: %v", err)
+	}
+	backend.Service.Name = "modified"
+	backend.Config = "modified"
+	stored, err := storage.GetRouteStepByNamespacedName(ctx, "default", "example", 1)
+	if err != nil {
+		t.Fatalf("could not get step: %v", err)
+	}
+	if stored.Service.Name != "backend" || stored.Config != "{}" {
+		t.Fatalf("stored step was modified through a response: %v", stored)
+	}
+}
+
+func TestServicesAndTheirEndpoints(t *testing.T) {
+	storage := newStorage(t)
+	ctx := context.Background()
+
+	if err := storage.SetService(ctx, "default", "backend", &protoStorage.Service{Environment: map[string]string{"key": "value"}}); err != nil {
+		t.Fatalf("could not set service: %v", err)
+	}
+	if err := storage.SetServiceLBEndpoints(ctx, "default", "backend", []*protoCommon.Endpoint{{Host: "backend", Port: 8080}}); err != nil {
+		t.Fatalf("could not set endpoints: %v", err)
+	}
+	service, err := storage.GetService(ctx, "default", "backend")
+	if err != nil || service.Environment["key"] != "value" {
+		t.Fatalf("unexpected service: %v, %v", service, err)
+	}
+	namespaces, err := storage.GetNamespaces(ctx)
+	if err != nil || len(namespaces) != 1 || namespaces[0] != "default" {
+		t.Fatalf("unexpected namespaces: %v, %v", namespaces, err)
+	}
+
+	// deleting the service removes its endpoints as well
+	if err := storage.DeleteService(ctx, "default", "backend"); err != nil {
+		t.Fatalf("could not delete service: %v", err)
+	}
+	if _, err := storage.GetService(ctx, "default", "backend"); !errors.Is(err, communication.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	endpoints, err := storage.GetServiceLBEndpoints(ctx, "default", "backend")
+	if err != nil || len(endpoints) != 0 {
+		t.Fatalf("expected no endpoints, got %v, %v", endpoints, err)
+	}
+}
+
+func TestInvalidRequestsAndMissingResources(t *testing.T) {
+	storage := newStorage(t)
+	ctx := context.Background()
+
+	if _, err := storage.GetRouteByNamespacedName(ctx, "default", "missing"); !errors.Is(err, communication.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := storage.DeleteRoute(ctx, "default", "missing"); !errors.Is(err, communication.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := storage.SetService(ctx, "", "backend", &protoStorage.Service{}); !errors.Is(err, communication.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := storage.GetRouteStart(ctx, "unknown.com"); !errors.Is(err, communication.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestWritesWithOutdatedVersionsConflict(t *testing.T) {
+	storage := newStorage(t)
+	ctx := context.Background()
+
+	version, err := storage.SetServiceIfVersion(ctx, "default", "backend", &protoStorage.Service{}, communication.NoVersion)
+	if err != nil {
+		t.Fatalf("could not create service: %v", err)
+	}
+	if _, err := storage.SetServiceIfVersion(ctx, "default", "backend", &protoStorage.Service{}, communication.NoVersion); !errors.Is(err, communication.ErrConflict) {
+		t.Fatalf("expected ErrConflict when creating an existing service, got %v", err)
+	}
+	updated := &protoStorage.Service{Environment: map[string]string{"key": "value"}}
+	if _, err := storage.SetServiceIfVersion(ctx, "default", "backend", updated, version); err != nil {
+		t.Fatalf("could not update service: %v", err)
+	}
+	if _, err := storage.SetServiceIfVersion(ctx, "default", "backend", updated, version); !errors.Is(err, communication.ErrConflict) {
+		t.Fatalf("expected ErrConflict for an outdated version, got %v", err)
+	}
+}
+
+func TestUpdatesStartOverAfterConcurrentChanges(t *testing.T) {
+	storage := newStorage(t)
+	ctx := context.Background()
+
+	attempts := 0
+	err := storage.UpdateService(ctx, "default", "backend", func(current *protoStorage.Service) (*protoStorage.Service, error) {
+		attempts++
+		if attempts == 1 {
+			// another writer creates the service after it was read
+			if err := storage.SetService(ctx, "default", "backend", &protoStorage.Service{Environment: map[string]string{"other": "value"}}); err != nil {
+				t.Fatalf("could not set service: %v", err)
+			}
+		}
+		updated := &protoStorage.Service{Environment: map[string]string{"key": "value"}}
+		for key, value := range current.GetEnvironment() {
+			updated.Environment[key] = value
+		}
+		return updated, nil
+	})
+	if err != nil {
+		t.Fatalf("could not update service: %v", err)
+	}
+	service, err := storage.GetService(ctx, "default", "backend")
+	if err != nil || attempts != 2 || service.Environment["other"] != "value" || service.Environment["key"] != "value" {
+		t.Fatalf("unexpected service after %d attempts: %v, %v", attempts, service, err)
+	}
+}
@@ -0,0 +1,74 @@
+package communication
+
+import (
+	"fmt"
+	"path"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+)
+
+// ResourceFilter matches resources using glob patterns as understood by path.Match
+// Empty patterns match everything
+type ResourceFilter struct {
+	Type      string
+	Namespace string
+	Name      string
+}
+
+func (filter ResourceFilter) validate() error {
+	for _, pattern := range []string{filter.Type, filter.Namespace, filter.Name} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid resource filter pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (filter ResourceFilter) Matches(resource *protoCommon.Resource) bool {
+	return matchPattern(filter.Type, resource.Type) &&
+		matchPattern(filter.Namespace, resource.Namespace) &&
+		matchPattern(filter.Name, resource.Name)
+}
+
+func matchPattern(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	// patterns have been validated when subscribing
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+// Only deliver events concerning resources matching at least one of the filters
+// Events that do not concern a resource are not filtered
+func WithResourceFilter(filters ...ResourceFilter) SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.filters = append(options.filters, filters...)
+	}
+}
+
+func (subscription *Subscription) accepts(event Event) bool {
+	if len(subscription.filters) == 0 {
+		return true
+	}
+	resource := eventResource(event)
+	if resource == nil {
+		return true
+	}
+	for _, filter := range subscription.filters {
+		if filter.Matches(resource) {
+			return true
+		}
+	}
+	return false
+}
+
+func (subscription *Subscription) acceptedEvents(events []Event) []Event {
+	accepted := make([]Event, 0, len(events))
+	for _, event := range events {
+		if subscription.accepts(event) {
+			accepted = append(accepted, event)
+		}
+	}
+	return accepted
+}
@@ -0,0 +1,34 @@
+package communication
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthRegistry serves the standard grpc.health.v1.Health service
+// The overall health of the server is reported for the empty service name
+type HealthRegistry struct {
+	server *health.Server
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{server: health.NewServer()}
+}
+
+func (registry *HealthRegistry) Register(server *grpc.Server) {
+	healthpb.RegisterHealthServer(server, registry.server)
+}
+
+func (registry *HealthRegistry) SetServing(service string, serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	registry.server.SetServingStatus(service, status)
+}
+
+// Report all services as NOT_SERVING, further updates are ignored
+func (registry *HealthRegistry) Shutdown() {
+	registry.server.Shutdown()
+}
@@ -0,0 +1,90 @@
+package communication
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes an exponential backoff with jitter
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// fraction of the interval that is randomly added or subtracted, 0 disables jitter
+	Jitter float64
+	// stop retrying once this duration has passed since the first attempt, 0 retries forever
+	MaxElapsedTime time.Duration
+}
+
+// Default policy used to register to the control plane and to reconnect to it
+// It retries forever, callers can limit it using the context
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     30 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		MaxElapsedTime:  0,
+	}
+}
+
+// Call operation until it succeeds, the policy gives up or ctx is done
+// The returned error wraps the last error of operation or the error of ctx
+func (policy RetryPolicy) Retry(ctx context.Context, operation func() error) error {
+	b := policy.newBackoff()
+	for {
+		err := operation()
+		if err == nil {
+			return nil
+		}
+
+		wait, ok := b.next()
+		if !ok {
+			return fmt.Errorf("giving up after %v: %w", time.Since(b.start), err)
+		}
+		logger.Infow("retrying", "error", err, "retryIn", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+type backoff struct {
+	policy   RetryPolicy
+	interval time.Duration
+	start    time.Time
+}
+
+func (policy RetryPolicy) newBackoff() *backoff {
+	return &backoff{
+		policy:   policy,
+		interval: policy.InitialInterval,
+		start:    time.Now(),
+	}
+}
+
+// returns the duration to wait before the next attempt or false if the policy is exhausted
+func (b *backoff) next() (time.Duration, bool) {
+	if b.policy.MaxElapsedTime > 0 && time.Since(b.start) >= b.policy.MaxElapsedTime {
+		return 0, false
+	}
+
+	wait := b.interval
+	if b.policy.Jitter > 0 {
+		delta := b.policy.Jitter * float64(wait)
+		wait = time.Duration(float64(wait) - delta + rand.Float64()*2*delta)
+	}
+
+	b.interval = time.Duration(float64(b.interval) * b.policy.Multiplier)
+	if b.policy.MaxInterval > 0 && b.interval > b.policy.MaxInterval {
+		b.interval = b.policy.MaxInterval
+	}
+	return wait, true
+}
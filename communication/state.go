@@ -0,0 +1,156 @@
+package communication
+
+import (
+	"container/list"
+	"sort"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+)
+
+// at most this many events concerning resources are remembered, the least recently updated ones are forgotten first
+const maxRememberedResourceEvents = 4096
+
+// Deliver the most recent event of the subscribed type right after subscribing
+// For events concerning a resource the most recent event of every resource is delivered.
+// Those are only remembered while a subscription of their type uses WithReplay, so the first one
+// only receives events that do not concern a resource.
+func WithReplay() SubscribeOption {
+	return func(options *subscribeOptions) {
+		options.replay = true
+	}
+}
+
+// remember event as most recent one of its type or resource
+// has to be called while holding subscriptionsMutex, so subscribers replay a consistent state
+func (communicator *ControlPlaneCommunicator) rememberEvent(event Event) {
+	resource := eventResource(event)
+	if resource == nil {
+		// bounded by the number of event types
+		communicator.lastEvents[string(event.GetType())] = event
+		return
+	}
+
+	if componentLeft(event) {
+		// replaying it after a later registration of the component would have it leave again
+		communicator.forgetResource(resource)
+		return
+	}
+	if communicator.replayTypes[event.GetType()] == 0 {
+		return
+	}
+
+	if communicator.resourceEvents == nil {
+		communicator.resourceEvents = list.New()
+		communicator.resourceEventElements = make(map[string]*list.Element)
+	}
+	key := resourceEventKey(event.GetType(), resource)
+	communicator.lastEvents[key] = event
+	if element, ok := communicator.resourceEventElements[key]; ok {
+		communicator.resourceEvents.MoveToBack(element)
+	} else {
+		communicator.resourceEventElements[key] = communicator.resourceEvents.PushBack(key)
+	}
+	if communicator.resourceEvents.Len() > maxRememberedResourceEvents {
+		communicator.forgetKey(communicator.resourceEvents.Front().Value.(string))
+	}
+}
+
+// has to be called while holding subscriptionsMutex
+func (communicator *ControlPlaneCommunicator) forgetKey(key string) {
+	delete(communicator.lastEvents, key)
+	if element, ok := communicator.resourceEventElements[key]; ok {
+		communicator.resourceEvents.Remove(element)
+		delete(communicator.resourceEventElements, key)
+	}
+}
+
+// forget the events of all types concerning resource
+// has to be called while holding subscriptionsMutex
+func (communicator *ControlPlaneCommunicator) forgetResource(resource *protoCommon.Resource) {
+	for key := range communicator.resourceEventElements {
+		remembered := eventResource(communicator.lastEvents[key])
+		if remembered != nil && remembered.Type == resource.Type && remembered.Namespace == resource.Namespace && remembered.Name == resource.Name {
+			communicator.forgetKey(key)
+		}
+	}
+}
+
+// has to be called while holding subscriptionsMutex
+func (communicator *ControlPlaneCommunicator) addReplay(eventType EventType) {
+	if communicator.replayTypes == nil {
+		communicator.replayTypes = make(map[EventType]int)
+	}
+	communicator.replayTypes[eventType]++
+}
+
+// forgets the events concerning resources of eventType once no subscription replays them anymore
+// has to be called while holding subscriptionsMutex
+func (communicator *ControlPlaneCommunicator) removeReplay(eventType EventType) {
+	communicator.replayTypes[eventType]--
+	if communicator.replayTypes[eventType] > 0 {
+		return
+	}
+	delete(communicator.replayTypes, eventType)
+	for key := range communicator.resourceEventElements {
+		if communicator.lastEvents[key].GetType() == eventType {
+			communicator.forgetKey(key)
+		}
+	}
+}
+
+// the events of components that deregistered or crashed are of no use anymore, neither are those events themselves
+func componentLeft(event Event) bool {
+	componentEvent, ok := event.(*ComponentEvent)
+	if !ok {
+		return false
+	}
+	switch componentEvent.Type {
+	case ComponentDeregisteredEvent:
+		return true
+	case ComponentCrashedEvent:
+		crash, _ := componentEvent.Crash()
+		return !crash.Recovered
+	default:
+		return false
+	}
+}
+
+// most recent events of eventType ordered by key
+// has to be called while holding subscriptionsMutex
+func (communicator *ControlPlaneCommunicator) lastEventsOfType(eventType EventType) []Event {
+	keys := make([]string, 0)
+	for key, event := range communicator.lastEvents {
+		if event.GetType() == eventType {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	events := make([]Event, 0, len(keys))
+	for _, key := range keys {
+		events = append(events, communicator.lastEvents[key])
+	}
+	return events
+}
+
+// Returns the most recent event of eventType
+// resource has to be set for events concerning a resource, otherwise it has to be nil.
+// Events concerning a resource are only known while a subscription of their type uses WithReplay.
+func (communicator *ControlPlaneCommunicator) LastEvent(eventType EventType, resource *protoCommon.Resource) Event {
+	communicator.subscriptionsMutex.RLock()
+	defer communicator.subscriptionsMutex.RUnlock()
+	key := string(eventType)
+	if resource != nil {
+		key = resourceEventKey(eventType, resource)
+	}
+	return communicator.lastEvents[key]
+}
+
+// Returns the storage endpoints of the most recent StorageChanged event
+func (communicator *ControlPlaneCommunicator) Current() []*protoCommon.Endpoint {
+	event, ok := communicator.LastEvent(StorageChangedEvent, nil).(*StorageChanged)
+	if !ok {
+		return nil
+	}
+	return event.Endpoints
+}
@@ -0,0 +1,83 @@
+package communication_test
+
+import (
+	"testing"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+)
+
+func TestResourceEventsAreOnlyRememberedForReplay(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, 3)
+
+	first := communication.NewResource("route", "default", "first")
+	second := communication.NewResource("route", "default", "second")
+	received := make(chan communication.Event, 16)
+	plain, err := communicator.Subscribe(communication.ConfigurationChangedEvent, func(event communication.Event) {
+		received <- event
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	controlPlane.Push(communication.NewConfigurationChanged(first).ToGrpcEvent())
+	<-received
+	if communicator.LastEvent(communication.ConfigurationChangedEvent, first) != nil {
+		t.Fatal("event was remembered without a subscription replaying it")
+	}
+
+	replaying, err := communicator.Subscribe(communication.ConfigurationChangedEvent, func(communication.Event) {}, communication.WithReplay())
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	controlPlane.Push(communication.NewConfigurationChanged(first).ToGrpcEvent())
+	controlPlane.Push(communication.NewConfigurationChanged(second).ToGrpcEvent())
+	eventually(t, func() bool {
+		return communicator.LastEvent(communication.ConfigurationChangedEvent, second) != nil
+	}, "event was not remembered for replay")
+
+	replayed := make(chan communication.Event, 16)
+	late, err := communicator.Subscribe(communication.ConfigurationChangedEvent, func(event communication.Event) {
+		replayed <- event
+	}, communication.WithReplay())
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	eventually(t, func() bool { return len(replayed) == 2 }, "remembered events were not replayed")
+
+	for _, subscription := range []*communication.Subscription{replaying, late} {
+		if err := subscription.Unsubscribe(); err != nil {
+			t.Fatalf("could not unsubscribe: %v", err)
+		}
+	}
+	if communicator.LastEvent(communication.ConfigurationChangedEvent, first) != nil {
+		t.Fatal("events are still remembered after the last replaying subscription was removed")
+	}
+	if err := plain.Unsubscribe(); err != nil {
+		t.Fatalf("could not unsubscribe: %v", err)
+	}
+}
+
+func TestEventsOfDeregisteredComponentsAreForgotten(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, 4)
+
+	for _, eventType := range []communication.EventType{communication.ComponentStatusEvent, communication.ComponentDeregisteredEvent} {
+		if _, err := communicator.Subscribe(eventType, func(communication.Event) {}, communication.WithReplay()); err != nil {
+			t.Fatalf("could not subscribe: %v", err)
+		}
+	}
+
+	status := communication.NewComponentStatus("worker", "worker:1", &communication.Status{Healthy: true})
+	controlPlane.Push(status.ToGrpcEvent())
+	eventually(t, func() bool {
+		return communicator.LastEvent(communication.ComponentStatusEvent, status.Component) != nil
+	}, "status was not remembered")
+
+	controlPlane.Push(communication.NewComponentDeregistered("worker", "worker:1").ToGrpcEvent())
+	eventually(t, func() bool {
+		return communicator.LastEvent(communication.ComponentStatusEvent, status.Component) == nil
+	}, "status of a deregistered component is still remembered")
+}
@@ -0,0 +1,125 @@
+package communication
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Status is reported to the control plane periodically
+type Status struct {
+	Healthy          bool
+	Ready            bool
+	InFlightRequests int64
+	Version          string
+	// custom load figures, e.g. queue lengths
+	Load map[string]string
+}
+
+// StatusProvider contributes its fields to the reported status
+type StatusProvider func(status *Status)
+
+// Report status to the control plane every interval, 0 disables heartbeats
+func WithHeartbeat(interval time.Duration, providers ...StatusProvider) RegisterOption {
+	return func(options *registerOptions) {
+		options.heartbeatInterval = interval
+		options.statusProviders = append(options.statusProviders, providers...)
+	}
+}
+
+// add provider that is asked for its fields every time the status is reported
+func (communicator *ControlPlaneCommunicator) AddStatusProvider(provider StatusProvider) {
+	communicator.statusMutex.Lock()
+	defer communicator.statusMutex.Unlock()
+	communicator.statusProviders = append(communicator.statusProviders, provider)
+}
+
+// Collect the status from all providers
+func (communicator *ControlPlaneCommunicator) Status() *Status {
+	communicator.statusMutex.Lock()
+	providers := make([]StatusProvider, len(communicator.statusProviders))
+	copy(providers, communicator.statusProviders)
+	communicator.statusMutex.Unlock()
+
+	status := &Status{
+		Healthy: true,
+		Ready:   true,
+		Load:    make(map[string]string),
+	}
+	for _, provider := range providers {
+		provider(status)
+	}
+	return status
+}
+
+// Report the current status to the control plane
+// The status is sent as details of the ComponentStatus event, so it reaches every component listening to it
+func (communicator *ControlPlaneCommunicator) ReportStatus(ctx context.Context) error {
+	if communicator.ctx == nil {
+		return ErrNotRegistered
+	}
+	event := NewComponentStatus(communicator.typeName, communicator.identifier, communicator.Status())
+	_, err := communicator.controlPlaneClient.CreateEvent(ctx, event.ToGrpcEvent())
+	return err
+}
+
+// Report the status every interval until the communicator is closed
+// The communicator has to be registered first, see RegisterThisService
+func (communicator *ControlPlaneCommunicator) StartHeartbeat(interval time.Duration) error {
+	if communicator.ctx == nil {
+		return ErrNotRegistered
+	}
+	communicator.background.Add(1)
+	Go("heartbeat", func() {
+		defer communicator.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-communicator.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if communicator.ConnectionState() != Connected {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(communicator.ctx, interval)
+			err := communicator.ReportStatus(ctx)
+			cancel()
+			if err != nil {
+				logger.Warnw("could not report status", "error", err)
+			}
+		}
+	})
+	return nil
+}
+
+// RequestCounter counts requests currently being processed
+// Its Provide method can be used as StatusProvider
+type RequestCounter struct {
+	mutex    sync.Mutex
+	inFlight int64
+}
+
+func (counter *RequestCounter) Start() {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.inFlight++
+}
+
+func (counter *RequestCounter) Done() {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.inFlight--
+}
+
+func (counter *RequestCounter) InFlight() int64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.inFlight
+}
+
+func (counter *RequestCounter) Provide(status *Status) {
+	status.InFlightRequests += counter.InFlight()
+}
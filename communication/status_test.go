@@ -0,0 +1,60 @@
+package communication_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+)
+
+func TestStatusIsRelayedToListeningComponents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	listener := register(t, controlPlane, 5)
+	reporter := register(t, controlPlane, 6)
+
+	received := make(chan *communication.Status, 1)
+	if _, err := listener.Subscribe(communication.ComponentStatusEvent, func(event communication.Event) {
+		if status, ok := event.(*communication.ComponentEvent).Status(); ok {
+			received <- status
+		}
+	}); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	reporter.AddStatusProvider(func(status *communication.Status) {
+		status.Ready = false
+		status.InFlightRequests = 3
+		status.Version = "1.2.3"
+		status.Load["Queue Length"] = "7"
+		status.Load["a&b=c?d"] = "1"
+	})
+	if err := reporter.ReportStatus(context.Background()); err != nil {
+		t.Fatalf("could not report status: %v", err)
+	}
+
+	select {
+	case status := <-received:
+		if !status.Healthy || status.Ready || status.InFlightRequests != 3 || status.Version != "1.2.3" {
+			t.Fatalf("unexpected status: %+v", status)
+		}
+		if status.Load["Queue Length"] != "7" || status.Load["a&b=c?d"] != "1" || len(status.Load) != 2 {
+			t.Fatalf("unexpected load: %v", status.Load)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("status was not relayed")
+	}
+}
+
+func TestHeartbeatRequiresRegistration(t *testing.T) {
+	communicator := communication.NewControlPlaneCommunicatorWithoutStorage()
+	if err := communicator.StartHeartbeat(time.Second); !errors.Is(err, communication.ErrNotRegistered) {
+		t.Fatalf("expected ErrNotRegistered, got %v", err)
+	}
+	if err := communicator.ReportStatus(context.Background()); !errors.Is(err, communication.ErrNotRegistered) {
+		t.Fatalf("expected ErrNotRegistered, got %v", err)
+	}
+}
@@ -3,16 +3,68 @@ package communication
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
+
 	protoCommon "github.com/kulycloud/protocol/common"
 	protoStorage "github.com/kulycloud/protocol/storage"
+	"google.golang.org/protobuf/proto"
 )
 
+// replaced connections are closed once their calls are finished, but not later than this
+const storageDrainTimeout = 30 * time.Second
+
 var _ RemoteComponent = &StorageCommunicator{}
 
+// StorageCommunicator can be used from multiple goroutines while its connection is replaced
+// It used to embed *ComponentCommunicator and export the Endpoints field, which could not be replaced safely:
+// use the methods ComponentCommunicator and Endpoints instead.
 type StorageCommunicator struct {
-	*ComponentCommunicator
-	storageClient protoStorage.StorageClient
-	Endpoints     []*protoCommon.Endpoint
+	// guards connection, endpoints and cache
+	mutex      sync.RWMutex
+	connection *storageConnection
+	endpoints  []*protoCommon.Endpoint
+	// set if enabled by EnableCache
+	cache *storageCache
+	// serializes updates of the endpoints, they are pinged without holding mutex
+	updateMutex sync.Mutex
+
+	watchMutex sync.Mutex
+	watchers   map[*storageWatcher]bool
+
+	// changes are only subscribed to while the cache is enabled or resources are watched
+	changeMutex        sync.Mutex
+	changeSource       changeSource
+	changeConsumers    int
+	unsubscribeChanges func()
+
+	// last readiness reported to ReadinessChanged
+	ready        bool
+	readyChanged chan struct{}
+	readyMutex   sync.Mutex
+}
+
+// connection that is closed once all calls acquired on it are released
+type storageConnection struct {
+	communicator *ComponentCommunicator
+	client       protoStorage.StorageClient
+	// set if the endpoints are managed by SetEndpoints
+	pool     *storagePool
+	inFlight sync.WaitGroup
+}
+
+func newStorageConnection(componentCommunicator *ComponentCommunicator, pool *storagePool) *storageConnection {
+	return &storageConnection{
+		communicator: componentCommunicator,
+		client:       protoStorage.NewStorageClient(componentCommunicator.GrpcClient),
+		pool:         pool,
+	}
+}
+
+// wait for calls in flight, then close the connection
+func (connection *storageConnection) drainAndClose() error {
+	waitWithTimeout(&connection.inFlight, storageDrainTimeout)
+	return connection.communicator.Close()
 }
 
 func NewEmptyStorageCommunicator() *StorageCommunicator {
@@ -20,218 +72,501 @@ func NewEmptyStorageCommunicator() *StorageCommunicator {
 }
 
 func NewStorageCommunicator(componentCommunicator *ComponentCommunicator) *StorageCommunicator {
-	return &StorageCommunicator{ComponentCommunicator: componentCommunicator, storageClient: protoStorage.NewStorageClient(componentCommunicator.GrpcClient)}
+	return &StorageCommunicator{connection: newStorageConnection(componentCommunicator, nil), ready: true}
 }
 
 func (communicator *StorageCommunicator) Ready() bool {
-	return communicator.storageClient != nil
+	communicator.mutex.RLock()
+	defer communicator.mutex.RUnlock()
+	if communicator.connection == nil {
+		return false
+	}
+	if communicator.connection.pool != nil {
+		return communicator.connection.pool.hasHealthy()
+	}
+	return true
 }
 
-func (communicator *StorageCommunicator) UpdateComponentCommunicator(componentCommunicator *ComponentCommunicator) {
-	communicator.ComponentCommunicator = componentCommunicator
+// Endpoints set by SetEndpoints
+func (communicator *StorageCommunicator) Endpoints() []*protoCommon.Endpoint {
+	communicator.mutex.RLock()
+	defer communicator.mutex.RUnlock()
+	return communicator.endpoints
+}
 
+// Connection currently used to reach the storage, nil if there is none
+// It is closed once it is replaced, so it should not be kept: calls made using the methods of the
+// StorageCommunicator are safe while the connection is replaced.
+func (communicator *StorageCommunicator) ComponentCommunicator() *ComponentCommunicator {
+	communicator.mutex.RLock()
+	defer communicator.mutex.RUnlock()
+	if communicator.connection == nil {
+		return nil
+	}
+	return communicator.connection.communicator
+}
+
+func (communicator *StorageCommunicator) Ping(ctx context.Context) error {
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return connection.communicator.Ping(ctx)
+}
+
+// Connect to all endpoints, calls are sent to a healthy one and fail over to the others
+// Returns an error if none of the endpoints is healthy, they are probed in the background until they recover
+func (communicator *StorageCommunicator) SetEndpoints(ctx context.Context, endpoints []*protoCommon.Endpoint) error {
+	communicator.updateMutex.Lock()
+	defer communicator.updateMutex.Unlock()
+
+	communicator.mutex.Lock()
+	connection := communicator.connection
+	communicator.endpoints = endpoints
+	communicator.mutex.Unlock()
+
+	defer communicator.resourceChanged(nil)
+	if connection != nil && connection.pool != nil {
+		return connection.pool.update(ctx, endpoints)
+	}
+
+	// connect before swapping, so calls are not sent to an empty pool
+	pool := newStoragePool(communicator.updateReadiness)
+	err := pool.update(ctx, endpoints)
+	communicator.replace(newStorageConnection(NewComponentCommunicator(pool), pool))
+	return err
+}
+
+// Replace the connection to the storage, the previous one is closed once its calls are finished
+func (communicator *StorageCommunicator) UpdateComponentCommunicator(componentCommunicator *ComponentCommunicator) {
+	var connection *storageConnection
 	if componentCommunicator != nil {
-		communicator.storageClient = protoStorage.NewStorageClient(componentCommunicator.GrpcClient)
-	} else {
-		communicator.storageClient = nil
+		connection = newStorageConnection(componentCommunicator, nil)
+	}
+	communicator.replace(connection)
+}
+
+// Close the connection to the storage after calls in flight are finished
+func (communicator *StorageCommunicator) Close() error {
+	previous := communicator.swap(nil)
+	if previous != nil {
+		return previous.drainAndClose()
+	}
+	return nil
+}
+
+// swap connection and close the previous one in the background
+func (communicator *StorageCommunicator) replace(connection *storageConnection) {
+	previous := communicator.swap(connection)
+	if previous != nil {
+		Go("close storage connection", func() {
+			if err := previous.drainAndClose(); err != nil {
+				logger.Warnw("could not close storage connection", "error", err)
+			}
+		})
+	}
+}
+
+func (communicator *StorageCommunicator) swap(connection *storageConnection) *storageConnection {
+	communicator.mutex.Lock()
+	previous := communicator.connection
+	communicator.connection = connection
+	communicator.mutex.Unlock()
+
+	communicator.updateReadiness()
+	return previous
+}
+
+// returns the current connection, it is not closed before release is called
+// fails with ErrStorageNotReady if there is no connection or it does not know any endpoint
+func (communicator *StorageCommunicator) acquire() (*storageConnection, func(), error) {
+	communicator.mutex.RLock()
+	defer communicator.mutex.RUnlock()
+	connection := communicator.connection
+	if connection == nil || (connection.pool != nil && connection.pool.empty()) {
+		return nil, nil, ErrStorageNotReady
+	}
+	// swapping requires the write lock, so no calls are added to a connection that is being drained
+	connection.inFlight.Add(1)
+	return connection, connection.inFlight.Done, nil
+}
+
+func waitWithTimeout(waitGroup *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warnw("closing storage connection with calls in flight", "timeout", timeout)
 	}
 }
 
 func (communicator *StorageCommunicator) GetRouteByNamespacedName(ctx context.Context, namespace string, name string) (*protoStorage.RouteWithId, error) {
-	resp, err := communicator.storageClient.GetRoute(ctx, &protoStorage.GetRouteRequest{Id: &protoStorage.GetRouteRequest_NamespacedName{NamespacedName: &protoStorage.NamespacedName{
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetRoute", namespace, name, err)
+	}
+	defer release()
+	resp, err := connection.client.GetRoute(ctx, &protoStorage.GetRouteRequest{Id: &protoStorage.GetRouteRequest_NamespacedName{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}}})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetRoute", namespace, name, err)
 	}
 
 	return resp.Route, nil
 }
 
 func (communicator *StorageCommunicator) GetRouteByUID(ctx context.Context, UID string) (*protoStorage.RouteWithId, error) {
-	resp, err := communicator.storageClient.GetRoute(ctx, &protoStorage.GetRouteRequest{Id: &protoStorage.GetRouteRequest_Uid{Uid: UID}})
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetRoute", "", UID, err)
+	}
+	defer release()
+	resp, err := connection.client.GetRoute(ctx, &protoStorage.GetRouteRequest{Id: &protoStorage.GetRouteRequest_Uid{Uid: UID}})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetRoute", "", UID, err)
 	}
 
 	return resp.Route, nil
 }
 
 func (communicator *StorageCommunicator) SetRouteByNamespacedName(ctx context.Context, namespace string, name string, route *protoStorage.Route) (string, error) {
-	resp, err := communicator.storageClient.SetRoute(ctx, &protoStorage.SetRouteRequest{NamespacedName: &protoStorage.NamespacedName{
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return "", newStorageError("SetRoute", namespace, name, err)
+	}
+	defer release()
+	resp, err := connection.client.SetRoute(ctx, &protoStorage.SetRouteRequest{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}, Data: route})
 
 	if err != nil {
-		return "", fmt.Errorf("error from storage provider: %w", err)
+		return "", newStorageError("SetRoute", namespace, name, err)
 	}
 
+	communicator.resourceChanged(NewResource(RouteResourceType, namespace, name))
 	return resp.Uid, nil
 }
 
 func (communicator *StorageCommunicator) GetRouteStepByNamespacedName(ctx context.Context, namespace string, name string, stepId uint32) (*protoStorage.RouteStep, error) {
-	resp, err := communicator.storageClient.GetRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_NamespacedName{NamespacedName: &protoStorage.NamespacedName{
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetRouteStep", namespace, name, err)
+	}
+	defer release()
+	resp, err := connection.client.GetRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_NamespacedName{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}}, StepId: stepId})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetRouteStep", namespace, name, err)
 	}
 
 	return resp.Step, nil
 }
 
 func (communicator *StorageCommunicator) GetRouteStepByUID(ctx context.Context, UID string, stepId uint32) (*protoStorage.RouteStep, error) {
-	resp, err := communicator.storageClient.GetRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_Uid{Uid: UID}, StepId: stepId})
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetRouteStep", "", UID, err)
+	}
+	defer release()
+	resp, err := connection.client.GetRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_Uid{Uid: UID}, StepId: stepId})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetRouteStep", "", UID, err)
 	}
 
 	return resp.Step, nil
 }
 
 func (communicator *StorageCommunicator) GetPopulatedRouteStepByNamespacedName(ctx context.Context, namespace string, name string, stepId uint32) (*protoStorage.PopulatedRouteStep, error) {
-	resp, err := communicator.storageClient.GetPopulatedRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_NamespacedName{NamespacedName: &protoStorage.NamespacedName{
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetPopulatedRouteStep", namespace, name, err)
+	}
+	defer release()
+	resp, err := connection.client.GetPopulatedRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_NamespacedName{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}}, StepId: stepId})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetPopulatedRouteStep", namespace, name, err)
 	}
 
 	return resp.Step, nil
 }
 
 func (communicator *StorageCommunicator) GetPopulatedRouteStepByUID(ctx context.Context, UID string, stepId uint32) (*protoStorage.PopulatedRouteStep, error) {
-	resp, err := communicator.storageClient.GetPopulatedRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_Uid{Uid: UID}, StepId: stepId})
+	cacheKey := fmt.Sprintf("%s%s/%d", populatedStepCachePrefix, UID, stepId)
+	cache := communicator.getCache()
+	cached, generation, ok := cache.get(cacheKey)
+	if ok {
+		return proto.Clone(cached.(*protoStorage.PopulatedRouteStep)).(*protoStorage.PopulatedRouteStep), nil
+	}
 
+	connection, release, err := communicator.acquire()
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetPopulatedRouteStep", "", UID, err)
 	}
+	defer release()
+	resp, err := connection.client.GetPopulatedRouteStep(ctx, &protoStorage.GetRouteStepRequest{Id: &protoStorage.GetRouteStepRequest_Uid{Uid: UID}, StepId: stepId})
 
+	if err != nil {
+		return nil, newStorageError("GetPopulatedRouteStep", "", UID, err)
+	}
+
+	if cache != nil && resp.Step != nil {
+		cache.set(cacheKey, proto.Clone(resp.Step), generation)
+	}
 	return resp.Step, nil
 }
 
 func (communicator *StorageCommunicator) GetRoutesInNamespace(ctx context.Context, namespace string) ([]string, error) {
-	resp, err := communicator.storageClient.GetRoutesInNamespace(ctx, &protoStorage.GetRoutesInNamespaceRequest{Namespace: namespace})
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetRoutesInNamespace", namespace, "", err)
+	}
+	defer release()
+	resp, err := connection.client.GetRoutesInNamespace(ctx, &protoStorage.GetRoutesInNamespaceRequest{Namespace: namespace})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetRoutesInNamespace", namespace, "", err)
 	}
 
 	return resp.RouteUids, nil
 }
 
 func (communicator *StorageCommunicator) GetRouteStart(ctx context.Context, host string) (*protoStorage.GetRouteStartResponse, error) {
-	resp, err := communicator.storageClient.GetRouteStart(ctx, &protoStorage.GetRouteStartRequest{Host: host})
+	cacheKey := routeStartCachePrefix + host
+	cache := communicator.getCache()
+	cached, generation, ok := cache.get(cacheKey)
+	if ok {
+		return proto.Clone(cached.(*protoStorage.GetRouteStartResponse)).(*protoStorage.GetRouteStartResponse), nil
+	}
 
+	connection, release, err := communicator.acquire()
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetRouteStart", "", host, err)
 	}
+	defer release()
+	resp, err := connection.client.GetRouteStart(ctx, &protoStorage.GetRouteStartRequest{Host: host})
 
+	if err != nil {
+		return nil, newStorageError("GetRouteStart", "", host, err)
+	}
+
+	if cache != nil {
+		cache.set(cacheKey, proto.Clone(resp), generation)
+	}
 	return resp, nil
 }
 
 func (communicator *StorageCommunicator) DeleteRoute(ctx context.Context, namespace string, name string) error {
-	_, err := communicator.storageClient.DeleteRoute(ctx, &protoStorage.DeleteRouteRequest{NamespacedName: &protoStorage.NamespacedName{
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return newStorageError("DeleteRoute", namespace, name, err)
+	}
+	defer release()
+	_, err = connection.client.DeleteRoute(ctx, &protoStorage.DeleteRouteRequest{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}})
 
 	if err != nil {
-		return fmt.Errorf("error from storage provider: %w", err)
+		return newStorageError("DeleteRoute", namespace, name, err)
 	}
 
+	communicator.resourceChanged(NewResource(RouteResourceType, namespace, name))
 	return nil
 }
 
 func (communicator *StorageCommunicator) GetService(ctx context.Context, namespace string, name string) (*protoStorage.Service, error) {
-	resp, err := communicator.storageClient.GetService(ctx, &protoStorage.GetServiceRequest{NamespacedName: &protoStorage.NamespacedName{
+	if err := checkServiceNamespace("GetService", namespace, name); err != nil {
+		return nil, err
+	}
+	return communicator.getService(ctx, namespace, name)
+}
+
+// also used for leases, which are stored as services
+func (communicator *StorageCommunicator) getService(ctx context.Context, namespace string, name string) (*protoStorage.Service, error) {
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetService", namespace, name, err)
+	}
+	defer release()
+	resp, err := connection.client.GetService(ctx, &protoStorage.GetServiceRequest{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetService", namespace, name, err)
 	}
 
 	return resp.Service, nil
 }
 
 func (communicator *StorageCommunicator) SetService(ctx context.Context, namespace string, name string, service *protoStorage.Service) error {
-	_, err := communicator.storageClient.SetService(ctx, &protoStorage.SetServiceRequest{NamespacedName: &protoStorage.NamespacedName{
+	if err := checkServiceNamespace("SetService", namespace, name); err != nil {
+		return err
+	}
+	if err := communicator.setService(ctx, namespace, name, service); err != nil {
+		return err
+	}
+
+	communicator.resourceChanged(NewResource(ServiceResourceType, namespace, name))
+	return nil
+}
+
+// also used for leases, which are stored as services
+func (communicator *StorageCommunicator) setService(ctx context.Context, namespace string, name string, service *protoStorage.Service) error {
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return newStorageError("SetService", namespace, name, err)
+	}
+	defer release()
+	_, err = connection.client.SetService(ctx, &protoStorage.SetServiceRequest{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}, Service: service})
 
 	if err != nil {
-		return fmt.Errorf("error from storage provider: %w", err)
+		return newStorageError("SetService", namespace, name, err)
 	}
-
 	return nil
 }
 
 func (communicator *StorageCommunicator) GetServicesInNamespace(ctx context.Context, namespace string) ([]string, error) {
-	resp, err := communicator.storageClient.GetServicesInNamespace(ctx, &protoStorage.GetServicesInNamespaceRequest{Namespace: namespace})
+	if err := checkServiceNamespace("GetServicesInNamespace", namespace, ""); err != nil {
+		return nil, err
+	}
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetServicesInNamespace", namespace, "", err)
+	}
+	defer release()
+	resp, err := connection.client.GetServicesInNamespace(ctx, &protoStorage.GetServicesInNamespaceRequest{Namespace: namespace})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetServicesInNamespace", namespace, "", err)
 	}
 
 	return resp.Names, nil
 }
 
 func (communicator *StorageCommunicator) GetServiceLBEndpoints(ctx context.Context, namespace string, name string) ([]*protoCommon.Endpoint, error) {
-	resp, err := communicator.storageClient.GetServiceLBEndpoints(ctx, &protoStorage.NamespacedName{
+	if err := checkServiceNamespace("GetServiceLBEndpoints", namespace, name); err != nil {
+		return nil, err
+	}
+	cacheKey := lbEndpointsCachePrefix + namespace + "/" + name
+	cache := communicator.getCache()
+	cached, generation, ok := cache.get(cacheKey)
+	if ok {
+		return cloneEndpoints(cached.([]*protoCommon.Endpoint)), nil
+	}
+
+	endpoints, err := communicator.fetchServiceLBEndpoints(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		cache.set(cacheKey, cloneEndpoints(endpoints), generation)
+	}
+	return endpoints, nil
+}
+
+// bypasses the cache
+func (communicator *StorageCommunicator) fetchServiceLBEndpoints(ctx context.Context, namespace string, name string) ([]*protoCommon.Endpoint, error) {
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return nil, newStorageError("GetServiceLBEndpoints", namespace, name, err)
+	}
+	defer release()
+	resp, err := connection.client.GetServiceLBEndpoints(ctx, &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetServiceLBEndpoints", namespace, name, err)
 	}
 
 	return resp.Endpoints, nil
 }
 
 func (communicator *StorageCommunicator) SetServiceLBEndpoints(ctx context.Context, namespace string, name string, endpoints []*protoCommon.Endpoint) error {
-	_, err := communicator.storageClient.SetServiceLBEndpoints(ctx, &protoStorage.SetServiceLBEndpointsRequest{ServiceName: &protoStorage.NamespacedName{
+	if err := checkServiceNamespace("SetServiceLBEndpoints", namespace, name); err != nil {
+		return err
+	}
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return newStorageError("SetServiceLBEndpoints", namespace, name, err)
+	}
+	defer release()
+	_, err = connection.client.SetServiceLBEndpoints(ctx, &protoStorage.SetServiceLBEndpointsRequest{ServiceName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}, Endpoints: endpoints})
 
 	if err != nil {
-		return fmt.Errorf("error from storage provider: %w", err)
+		return newStorageError("SetServiceLBEndpoints", namespace, name, err)
 	}
 
+	communicator.resourceChanged(NewResource(ServiceResourceType, namespace, name))
 	return nil
 }
 
 func (communicator *StorageCommunicator) DeleteService(ctx context.Context, namespace string, name string) error {
-	_, err := communicator.storageClient.DeleteService(ctx, &protoStorage.DeleteServiceRequest{NamespacedName: &protoStorage.NamespacedName{
+	if err := checkServiceNamespace("DeleteService", namespace, name); err != nil {
+		return err
+	}
+	connection, release, err := communicator.acquire()
+	if err != nil {
+		return newStorageError("DeleteService", namespace, name, err)
+	}
+	defer release()
+	_, err = connection.client.DeleteService(ctx, &protoStorage.DeleteServiceRequest{NamespacedName: &protoStorage.NamespacedName{
 		Namespace: namespace,
 		Name:      name,
 	}})
 
 	if err != nil {
-		return fmt.Errorf("error from storage provider: %w", err)
+		return newStorageError("DeleteService", namespace, name, err)
 	}
 
+	communicator.resourceChanged(NewResource(ServiceResourceType, namespace, name))
 	return nil
 }
 
 func (communicator *StorageCommunicator) GetNamespaces(ctx context.Context) ([]string, error) {
-	ns, err := communicator.storageClient.GetNamespaces(ctx, &protoCommon.Empty{})
+	connection, release, err := communicator.acquire()
 	if err != nil {
-		return nil, fmt.Errorf("error from storage provider: %w", err)
+		return nil, newStorageError("GetNamespaces", "", "", err)
+	}
+	defer release()
+	ns, err := connection.client.GetNamespaces(ctx, &protoCommon.Empty{})
+	if err != nil {
+		return nil, newStorageError("GetNamespaces", "", "", err)
 	}
 
-	return ns.Namespaces, nil
+	namespaces := make([]string, 0, len(ns.Namespaces))
+	for _, namespace := range ns.Namespaces {
+		if namespace != LeaseNamespace {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces, nil
 }
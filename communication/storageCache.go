@@ -0,0 +1,236 @@
+package communication
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+	"google.golang.org/protobuf/proto"
+)
+
+// resource types of ConfigurationChanged events the storage cache understands
+// events concerning other resource types clear the whole cache
+const (
+	RouteResourceType   = "route"
+	ServiceResourceType = "service"
+)
+
+const (
+	routeStartCachePrefix    = "routeStart/"
+	populatedStepCachePrefix = "populatedStep/"
+	lbEndpointsCachePrefix   = "lbEndpoints/"
+)
+
+// CacheConfig configures the read-through cache of the StorageCommunicator
+type CacheConfig struct {
+	// entries are fetched again once they are older than this, 0 keeps them until they are invalidated
+	TTL time.Duration
+	// least recently used entries are evicted once there are more, 0 does not limit the number of entries
+	MaxEntries int
+}
+
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+	Entries       int
+}
+
+// caches GetRouteStart, GetPopulatedRouteStepByUID and GetServiceLBEndpoints
+// values are cloned when stored and returned, so callers may modify them
+type storageCache struct {
+	config CacheConfig
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+	// incremented by every invalidation, so values fetched before it are not stored afterwards
+	generation uint64
+}
+
+type cacheEntry struct {
+	key    string
+	value  interface{}
+	expiry time.Time
+}
+
+func newStorageCache(config CacheConfig) *storageCache {
+	return &storageCache{
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// returns the cached value or the current generation, which has to be passed to set after fetching the value
+// a nil cache never contains a value
+func (cache *storageCache) get(key string) (interface{}, uint64, bool) {
+	if cache == nil {
+		return nil, 0, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.entries[key]
+	if ok {
+		entry := element.Value.(*cacheEntry)
+		if entry.expiry.IsZero() || time.Now().Before(entry.expiry) {
+			cache.lru.MoveToFront(element)
+			cache.stats.Hits++
+			return entry.value, cache.generation, true
+		}
+		cache.removeElement(element)
+	}
+	cache.stats.Misses++
+	return nil, cache.generation, false
+}
+
+// store value unless the cache was invalidated since generation was returned by get,
+// the value might have been fetched before the change causing the invalidation then
+func (cache *storageCache) set(key string, value interface{}, generation uint64) {
+	entry := &cacheEntry{key: key, value: value}
+	if cache.config.TTL > 0 {
+		entry.expiry = time.Now().Add(cache.config.TTL)
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.generation != generation {
+		return
+	}
+	if element, ok := cache.entries[key]; ok {
+		cache.removeElement(element)
+	}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	for cache.config.MaxEntries > 0 && cache.lru.Len() > cache.config.MaxEntries {
+		cache.removeElement(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+// remove entries that might depend on resource, nil clears the whole cache
+func (cache *storageCache) invalidate(resource *protoCommon.Resource) {
+	var matches func(key string) bool
+	switch resource.GetType() {
+	case RouteResourceType:
+		// the response does not tell which route it belongs to
+		matches = func(key string) bool {
+			return strings.HasPrefix(key, routeStartCachePrefix) || strings.HasPrefix(key, populatedStepCachePrefix)
+		}
+	case ServiceResourceType:
+		// route starts and populated steps contain the endpoints of the services they reference
+		endpointsKey := lbEndpointsCachePrefix + resource.Namespace + "/" + resource.Name
+		matches = func(key string) bool {
+			return key == endpointsKey || strings.HasPrefix(key, routeStartCachePrefix) || strings.HasPrefix(key, populatedStepCachePrefix)
+		}
+	default:
+		matches = func(string) bool { return true }
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.generation++
+	for key, element := range cache.entries {
+		if matches(key) {
+			cache.removeElement(element)
+			cache.stats.Invalidations++
+		}
+	}
+}
+
+func (cache *storageCache) getStats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	stats := cache.stats
+	stats.Entries = cache.lru.Len()
+	return stats
+}
+
+// has to be called while holding the mutex
+func (cache *storageCache) removeElement(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*cacheEntry).key)
+}
+
+func cloneEndpoints(endpoints []*protoCommon.Endpoint) []*protoCommon.Endpoint {
+	if endpoints == nil {
+		return nil
+	}
+	cloned := make([]*protoCommon.Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		cloned = append(cloned, proto.Clone(endpoint).(*protoCommon.Endpoint))
+	}
+	return cloned
+}
+
+// Cache GetRouteStart, GetPopulatedRouteStepByUID and GetServiceLBEndpoints
+// Entries are invalidated by writes of this communicator and by InvalidateCache,
+// registering with WithStorageCache invalidates them on ConfigurationChanged events as well
+func (communicator *StorageCommunicator) EnableCache(config CacheConfig) {
+	communicator.mutex.Lock()
+	enabled := communicator.cache != nil
+	communicator.cache = newStorageCache(config)
+	communicator.mutex.Unlock()
+	if !enabled {
+		communicator.acquireChanges()
+	}
+}
+
+// nil if the cache is not enabled
+func (communicator *StorageCommunicator) getCache() *storageCache {
+	communicator.mutex.RLock()
+	defer communicator.mutex.RUnlock()
+	return communicator.cache
+}
+
+// Remove cached entries that might depend on resource, nil clears the whole cache
+func (communicator *StorageCommunicator) InvalidateCache(resource *protoCommon.Resource) {
+	if cache := communicator.getCache(); cache != nil {
+		cache.invalidate(resource)
+	}
+}
+
+// Returns zero stats if the cache is not enabled
+func (communicator *StorageCommunicator) CacheStats() CacheStats {
+	cache := communicator.getCache()
+	if cache == nil {
+		return CacheStats{}
+	}
+	return cache.getStats()
+}
+
+// Enable the read-through cache of the storage and keep it up to date using ConfigurationChanged events
+// The cache is cleared whenever the event stream is re-established, as events may have been missed meanwhile
+func WithStorageCache(config CacheConfig) RegisterOption {
+	return func(options *registerOptions) {
+		options.storageCache = &config
+	}
+}
+
+// keep the storage cache and watches up to date using ConfigurationChanged events
+// The events are only subscribed to while the cache is enabled or resources are watched. All of them are
+// refreshed whenever the event stream is re-established, as events may have been missed meanwhile
+func (communicator *ControlPlaneCommunicator) forwardStorageChanges() {
+	storage := communicator.Storage
+	communicator.RegisterConnectionStateHandler(func(state ConnectionState) {
+		if state == Connected {
+			storage.resourceChanged(nil)
+		}
+	})
+	storage.setChangeSource(func() (func(), error) {
+		subscription, err := communicator.RegisterConfigurationChangedHandler(func(event *ConfigurationChanged) {
+			storage.resourceChanged(event.Resource)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			if err := subscription.Unsubscribe(); err != nil {
+				logger.Warnw("Could not unsubscribe from configuration changes of the storage", "error", err)
+			}
+		}, nil
+	})
+}
@@ -0,0 +1,25 @@
+package communication
+
+import "testing"
+
+func TestValuesFetchedBeforeAnInvalidationAreNotCached(t *testing.T) {
+	cache := newStorageCache(CacheConfig{})
+	key := lbEndpointsCachePrefix + "default/example"
+
+	_, generation, ok := cache.get(key)
+	if ok {
+		t.Fatal("empty cache returned a value")
+	}
+	// the service changes while its endpoints are fetched
+	cache.invalidate(NewResource(ServiceResourceType, "default", "example"))
+	cache.set(key, "stale", generation)
+	if _, _, ok := cache.get(key); ok {
+		t.Fatal("value fetched before the invalidation was cached")
+	}
+
+	_, generation, _ = cache.get(key)
+	cache.set(key, "fresh", generation)
+	if value, _, ok := cache.get(key); !ok || value != "fresh" {
+		t.Fatalf("expected the fetched value to be cached, got %v", value)
+	}
+}
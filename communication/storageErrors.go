@@ -0,0 +1,85 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors of the storage, StorageCommunicator methods return a *StorageError matching one of them with errors.Is
+var (
+	ErrNotFound        = errors.New("resource not found")
+	ErrAlreadyExists   = errors.New("resource already exists")
+	ErrConflict        = errors.New("resource was modified concurrently")
+	ErrUnavailable     = errors.New("storage unavailable")
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+// StorageError describes a failed storage call
+// Resources addressed by UID or host carry it as Name
+type StorageError struct {
+	Operation string
+	Namespace string
+	Name      string
+	Code      codes.Code
+	Err       error
+}
+
+func newStorageError(operation string, namespace string, name string, err error) *StorageError {
+	code := status.Code(err)
+	if errors.Is(err, ErrStorageNotReady) {
+		code = codes.Unavailable
+	}
+	return &StorageError{
+		Operation: operation,
+		Namespace: namespace,
+		Name:      name,
+		Code:      code,
+		Err:       err,
+	}
+}
+
+func (e *StorageError) Error() string {
+	resource := e.Name
+	if e.Namespace != "" {
+		resource = e.Namespace + "/" + e.Name
+	}
+	if resource == "" {
+		return fmt.Sprintf("error from storage provider: %s: %v", e.Operation, e.Err)
+	}
+	return fmt.Sprintf("error from storage provider: %s %s: %v", e.Operation, resource, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// matches the sentinel error of its code
+func (e *StorageError) Is(target error) bool {
+	sentinel := sentinelForCode(e.Code)
+	return sentinel != nil && sentinel == target
+}
+
+// keeps the code when passed to status.Code or returned from a grpc handler
+func (e *StorageError) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Error())
+}
+
+func sentinelForCode(code codes.Code) error {
+	switch code {
+	case codes.NotFound:
+		return ErrNotFound
+	case codes.AlreadyExists:
+		return ErrAlreadyExists
+	case codes.Aborted, codes.FailedPrecondition:
+		return ErrConflict
+	case codes.Unavailable:
+		return ErrUnavailable
+	case codes.InvalidArgument, codes.OutOfRange:
+		return ErrInvalidArgument
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStorageErrorsMatchTheSentinelOfTheirCode(t *testing.T) {
+	sentinels := []error{ErrNotFound, ErrAlreadyExists, ErrConflict, ErrUnavailable, ErrInvalidArgument}
+	tests := []struct {
+		code     codes.Code
+		sentinel error
+	}{
+		{codes.NotFound, ErrNotFound},
+		{codes.AlreadyExists, ErrAlreadyExists},
+		{codes.Aborted, ErrConflict},
+		{codes.FailedPrecondition, ErrConflict},
+		{codes.Unavailable, ErrUnavailable},
+		{codes.InvalidArgument, ErrInvalidArgument},
+		{codes.OutOfRange, ErrInvalidArgument},
+		{codes.Internal, nil},
+		{codes.Unknown, nil},
+		{codes.OK, nil},
+	}
+
+	for _, test := range tests {
+		if sentinel := sentinelForCode(test.code); sentinel != test.sentinel {
+			t.Errorf("%v: expected %v, got %v", test.code, test.sentinel, sentinel)
+		}
+
+		err := newStorageError("GetService", "default", "backend", status.Error(test.code, "failed"))
+		// wrapping must not hide the sentinel
+		wrapped := fmt.Errorf("wrapped: %w", err)
+		for _, sentinel := range sentinels {
+			if matches := errors.Is(wrapped, sentinel); matches != (sentinel == test.sentinel) {
+				t.Errorf("%v: errors.Is(%v) returned %v", test.code, sentinel, matches)
+			}
+		}
+		if code := status.Code(err); code != test.code {
+			t.Errorf("%v: GRPCStatus returned %v", test.code, code)
+		}
+	}
+}
+
+func TestStorageNotReadyMatchesErrUnavailable(t *testing.T) {
+	err := newStorageError("GetService", "default", "backend", ErrStorageNotReady)
+	if !errors.Is(err, ErrStorageNotReady) || !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected %v to match ErrStorageNotReady and ErrUnavailable", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Fatal("not ready matches ErrNotFound")
+	}
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", code)
+	}
+	if message := err.Error(); message != "error from storage provider: GetService default/backend: storage is not ready" {
+		t.Fatalf("unexpected message: %s", message)
+	}
+}
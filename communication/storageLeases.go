@@ -0,0 +1,111 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Leases of elections are kept in this namespace
+// The protocol has no resource for them, so the storage keeps them as services. The service methods of
+// StorageCommunicator reject this namespace and GetNamespaces leaves it out, so leases never show up as services
+const LeaseNamespace = "kuly-leases"
+
+var ErrVersionsNotEnforced = errors.New("storage does not enforce expected versions")
+
+const (
+	leaseHolderKey = "holder"
+	leaseExpiryKey = "expiry"
+	leaseTokenKey  = "token"
+)
+
+// never matches a version computed by ResourceVersion
+const probeVersion = "version-probe"
+
+type lease struct {
+	holder string
+	expiry time.Time
+	token  uint64
+}
+
+func checkServiceNamespace(operation string, namespace string, name string) error {
+	if namespace == LeaseNamespace {
+		return newStorageError(operation, namespace, name, status.Error(codes.InvalidArgument, "namespace is reserved for leases"))
+	}
+	return nil
+}
+
+func encodeLease(l lease) *protoStorage.Service {
+	var expiry int64
+	if !l.expiry.IsZero() {
+		expiry = l.expiry.UnixNano()
+	}
+	return &protoStorage.Service{
+		Environment: map[string]string{
+			leaseHolderKey: l.holder,
+			leaseExpiryKey: strconv.FormatInt(expiry, 10),
+			leaseTokenKey:  strconv.FormatUint(l.token, 10),
+		},
+	}
+}
+
+func decodeLease(service *protoStorage.Service) (lease, error) {
+	expiry, err := strconv.ParseInt(service.Environment[leaseExpiryKey], 10, 64)
+	if err != nil {
+		return lease{}, fmt.Errorf("invalid lease expiry: %w", err)
+	}
+	token, err := strconv.ParseUint(service.Environment[leaseTokenKey], 10, 64)
+	if err != nil {
+		return lease{}, fmt.Errorf("invalid lease token: %w", err)
+	}
+	l := lease{holder: service.Environment[leaseHolderKey], token: token}
+	if expiry != 0 {
+		l.expiry = time.Unix(0, expiry)
+	}
+	return l, nil
+}
+
+// returns the lease and its version, a lease that does not exist is empty and has NoVersion
+func (communicator *StorageCommunicator) getLease(ctx context.Context, name string) (lease, string, error) {
+	service, err := communicator.getService(ctx, LeaseNamespace, name)
+	if errors.Is(err, ErrNotFound) {
+		return lease{}, NoVersion, nil
+	}
+	if err != nil {
+		return lease{}, NoVersion, err
+	}
+	l, err := decodeLease(service)
+	if err != nil {
+		return lease{}, NoVersion, err
+	}
+	return l, ResourceVersion(service), nil
+}
+
+// write the lease if it still has version, fails with ErrConflict otherwise
+// The version is only checked by the storage, see checkVersionEnforcement
+func (communicator *StorageCommunicator) setLeaseIfVersion(ctx context.Context, name string, l lease, version string) error {
+	return communicator.setService(withExpectedVersion(ctx, version), LeaseNamespace, name, encodeLease(l))
+}
+
+// Fails with ErrVersionsNotEnforced unless the storage rejects writes with an outdated expected version
+// The current lease is written back unchanged, so nothing is modified even if the storage accepts the write
+func (communicator *StorageCommunicator) checkVersionEnforcement(ctx context.Context, name string) error {
+	current, _, err := communicator.getLease(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = communicator.setLeaseIfVersion(ctx, name, current, probeVersion)
+	if errors.Is(err, ErrConflict) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ErrVersionsNotEnforced
+}
@@ -0,0 +1,271 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unhealthy storage endpoints are pinged this often to find out whether they recovered
+// only changed by tests
+var storageProbeInterval = 5 * time.Second
+
+var errNoStorageEndpoints = errors.New("no storage endpoints known")
+var errNoHealthyStorageEndpoints = errors.New("none of the storage endpoints is healthy")
+
+var _ grpc.ClientConnInterface = &storagePool{}
+
+// storagePool keeps connections to all storage endpoints and sends calls to a healthy one
+// Calls failing because the endpoint is unavailable mark it unhealthy, reads are retried on the next endpoint.
+// Unhealthy endpoints are probed in the background until they recover.
+type storagePool struct {
+	mutex     sync.Mutex
+	endpoints []*pooledEndpoint
+	current   *pooledEndpoint
+
+	cancelProbe   context.CancelFunc
+	probeInterval time.Duration
+	// called after the health of an endpoint changed
+	onHealthChange func()
+}
+
+type pooledEndpoint struct {
+	identifier   string
+	communicator *ComponentCommunicator
+	healthy      bool
+	inFlight     sync.WaitGroup
+}
+
+func newStoragePool(onHealthChange func()) *storagePool {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := &storagePool{cancelProbe: cancel, probeInterval: storageProbeInterval, onHealthChange: onHealthChange}
+	Go("storage probe", func() {
+		pool.probe(ctx)
+	})
+	return pool
+}
+
+// replace the endpoints of the pool, connections to endpoints that are still present are kept
+func (pool *storagePool) update(ctx context.Context, endpoints []*protoCommon.Endpoint) error {
+	pool.mutex.Lock()
+	existing := make(map[string]*pooledEndpoint, len(pool.endpoints))
+	for _, pooled := range pool.endpoints {
+		existing[pooled.identifier] = pooled
+	}
+	pool.mutex.Unlock()
+
+	updated := make([]*pooledEndpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		identifier := NewIdentifierFromEndpoint(endpoint)
+		if pooled, ok := existing[identifier]; ok {
+			updated = append(updated, pooled)
+			delete(existing, identifier)
+			continue
+		}
+
+		communicator, err := NewComponentCommunicatorFromEndpoint(endpoint)
+		if err != nil {
+			logger.Warnw("could not connect to storage endpoint", "endpoint", identifier, "error", err)
+			continue
+		}
+		pooled := &pooledEndpoint{identifier: identifier, communicator: communicator}
+		pooled.healthy = communicator.Ping(ctx) == nil
+		updated = append(updated, pooled)
+	}
+
+	pool.mutex.Lock()
+	pool.endpoints = updated
+	if pool.current != nil && existing[pool.current.identifier] == pool.current {
+		pool.current = nil
+	}
+	pool.mutex.Unlock()
+
+	pool.onHealthChange()
+
+	for _, removed := range existing {
+		removed := removed
+		Go("close storage endpoint", func() {
+			waitWithTimeout(&removed.inFlight, storageDrainTimeout)
+			_ = removed.communicator.Close()
+		})
+	}
+
+	if len(updated) == 0 {
+		return errNoStorageEndpoints
+	}
+	if !pool.hasHealthy() {
+		return errNoHealthyStorageEndpoints
+	}
+	return nil
+}
+
+func (pool *storagePool) empty() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.endpoints) == 0
+}
+
+func (pool *storagePool) hasHealthy() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, pooled := range pool.endpoints {
+		if pooled.healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// keep using the current endpoint while it is healthy, otherwise fail over to the next healthy one
+// endpoints are tried even if they are unhealthy once no healthy one is left, they may have recovered
+// the selected endpoint is not closed before its inFlight is done
+func (pool *storagePool) selectEndpoint(tried map[*pooledEndpoint]bool) *pooledEndpoint {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	selected := pool.selectEndpointLocked(tried)
+	if selected != nil {
+		// endpoints are removed while holding the mutex, so no calls are added to one being drained
+		selected.inFlight.Add(1)
+	}
+	return selected
+}
+
+func (pool *storagePool) selectEndpointLocked(tried map[*pooledEndpoint]bool) *pooledEndpoint {
+	if pool.current != nil && pool.current.healthy && !tried[pool.current] {
+		return pool.current
+	}
+
+	var fallback *pooledEndpoint
+	for _, pooled := range pool.endpoints {
+		if tried[pooled] {
+			continue
+		}
+		if pooled.healthy {
+			if pool.current != nil && pool.current != pooled {
+				logger.Infow("failing over to storage endpoint", "endpoint", pooled.identifier)
+			}
+			pool.current = pooled
+			return pooled
+		}
+		if fallback == nil {
+			fallback = pooled
+		}
+	}
+	return fallback
+}
+
+func (pool *storagePool) setHealthy(pooled *pooledEndpoint, healthy bool) {
+	pool.mutex.Lock()
+	if pooled.healthy == healthy {
+		pool.mutex.Unlock()
+		return
+	}
+	pooled.healthy = healthy
+	pool.mutex.Unlock()
+
+	if healthy {
+		logger.Infow("storage endpoint recovered", "endpoint", pooled.identifier)
+	} else {
+		logger.Warnw("storage endpoint unavailable", "endpoint", pooled.identifier)
+	}
+	pool.onHealthChange()
+}
+
+func (pool *storagePool) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	tried := make(map[*pooledEndpoint]bool)
+	var lastErr error
+	for {
+		pooled := pool.selectEndpoint(tried)
+		if pooled == nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return status.Error(codes.Unavailable, errNoStorageEndpoints.Error())
+		}
+
+		err := pooled.communicator.GrpcClient.Invoke(ctx, method, args, reply, opts...)
+		pooled.inFlight.Done()
+		if status.Code(err) != codes.Unavailable {
+			if err == nil {
+				pool.setHealthy(pooled, true)
+			}
+			return err
+		}
+		pool.setHealthy(pooled, false)
+		tried[pooled] = true
+		lastErr = err
+		if !isIdempotent(method) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// the storage does not have streaming calls, streams are opened on the selected endpoint without failover
+func (pool *storagePool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	pooled := pool.selectEndpoint(nil)
+	if pooled == nil {
+		return nil, status.Error(codes.Unavailable, errNoStorageEndpoints.Error())
+	}
+	defer pooled.inFlight.Done()
+	return pooled.communicator.GrpcClient.NewStream(ctx, desc, method, opts...)
+}
+
+func (pool *storagePool) probe(ctx context.Context) {
+	ticker := time.NewTicker(pool.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pool.mutex.Lock()
+		unhealthy := make([]*pooledEndpoint, 0)
+		for _, pooled := range pool.endpoints {
+			if !pooled.healthy {
+				unhealthy = append(unhealthy, pooled)
+			}
+		}
+		pool.mutex.Unlock()
+
+		for _, pooled := range unhealthy {
+			probeCtx, cancel := context.WithTimeout(ctx, pool.probeInterval)
+			if pooled.communicator.Ping(probeCtx) == nil {
+				pool.setHealthy(pooled, true)
+			}
+			cancel()
+		}
+	}
+}
+
+// stop probing and close the connections to all endpoints
+func (pool *storagePool) Close() error {
+	pool.cancelProbe()
+	pool.mutex.Lock()
+	endpoints := pool.endpoints
+	pool.endpoints = nil
+	pool.current = nil
+	pool.mutex.Unlock()
+
+	var firstErr error
+	for _, pooled := range endpoints {
+		if err := pooled.communicator.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// reads can safely be sent to another endpoint, writes might have been applied already
+func isIdempotent(method string) bool {
+	name := method[strings.LastIndex(method, "/")+1:]
+	return strings.HasPrefix(name, "Get") || name == "Ping"
+}
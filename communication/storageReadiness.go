@@ -0,0 +1,53 @@
+package communication
+
+import (
+	"context"
+	"errors"
+)
+
+// Returned by StorageCommunicator methods wrapped in a *StorageError as long as no storage is known
+// The error matches ErrUnavailable as well
+var ErrStorageNotReady = errors.New("storage is not ready")
+
+// Block until a healthy storage endpoint is available or ctx is done
+func (communicator *StorageCommunicator) WaitReady(ctx context.Context) error {
+	for {
+		changed := communicator.ReadinessChanged()
+		if communicator.Ready() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Returns a channel that is closed the next time Ready changes
+// Call it again afterwards to be notified of further changes
+func (communicator *StorageCommunicator) ReadinessChanged() <-chan struct{} {
+	communicator.readyMutex.Lock()
+	defer communicator.readyMutex.Unlock()
+	if communicator.readyChanged == nil {
+		communicator.readyChanged = make(chan struct{})
+	}
+	return communicator.readyChanged
+}
+
+// has to be called whenever the connection or the health of its endpoints changes, but not while holding mutex
+func (communicator *StorageCommunicator) updateReadiness() {
+	// computed while holding readyMutex, so concurrent updates cannot publish an outdated readiness
+	communicator.readyMutex.Lock()
+	defer communicator.readyMutex.Unlock()
+	ready := communicator.Ready()
+	if communicator.ready == ready {
+		return
+	}
+	communicator.ready = ready
+	if communicator.readyChanged != nil {
+		close(communicator.readyChanged)
+		communicator.readyChanged = nil
+	}
+	logger.Infow("storage readiness changed", "ready", ready)
+}
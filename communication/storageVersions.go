@@ -0,0 +1,254 @@
+package communication
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Writes with an expected version carry it as metadata, as the protocol has no field for it
+// Storages supporting it reject the write with Aborted if the resource has a different version
+//
+// Conditional writes (SetRouteIfVersion, SetServiceIfVersion, SetServiceLBEndpointsIfVersion and the Update helpers)
+// are only atomic if the storage checks this metadata. Otherwise the IfVersion methods merely compare the version
+// on the client right before writing and the Update helpers do not notice concurrent changes at all
+const ExpectedVersionMetadataKey = "kuly-expected-version"
+
+// Update helpers give up after this many conflicting attempts
+const maxUpdateAttempts = 10
+
+// conflicting updates wait before starting over, so concurrent writers do not keep running into each other
+var updateRetryPolicy = RetryPolicy{
+	InitialInterval: 10 * time.Millisecond,
+	MaxInterval:     time.Second,
+	Multiplier:      2,
+	Jitter:          0.5,
+}
+
+// Version of resources that do not exist
+const NoVersion = ""
+
+// Version of a route, service or list of LB endpoints
+// The protocol has no versions, so it is derived from the content: storages can compute it the same way
+func ResourceVersion(resource proto.Message) string {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(resource)
+	if err != nil {
+		// only happens for invalid messages, which never match a stored version
+		return NoVersion
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Version of a list of LB endpoints, services without LB endpoints have NoVersion
+func EndpointsVersion(endpoints []*protoCommon.Endpoint) string {
+	if len(endpoints) == 0 {
+		return NoVersion
+	}
+	return ResourceVersion(&protoCommon.EndpointList{Endpoints: endpoints})
+}
+
+// Returns the expected version sent along with the write, false if the write is unconditional
+// To be used by storage implementations
+func ExpectedVersionFromContext(ctx context.Context) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(ExpectedVersionMetadataKey)
+	if len(values) != 1 {
+		return "", false
+	}
+	return values[0], true
+}
+
+func withExpectedVersion(ctx context.Context, version string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, ExpectedVersionMetadataKey, version)
+}
+
+// compare the version of the stored resource before writing, as storages may ignore the expected version
+// this leaves a short window for concurrent writes, which only storages checking the version themselves close
+func checkVersion(operation string, namespace string, name string, expected string, current string) error {
+	if expected == current {
+		return nil
+	}
+	return newStorageError(operation, namespace, name, status.Errorf(codes.Aborted, "expected version %q, found %q", expected, current))
+}
+
+func (communicator *StorageCommunicator) GetRouteWithVersion(ctx context.Context, namespace string, name string) (*protoStorage.RouteWithId, string, error) {
+	route, err := communicator.GetRouteByNamespacedName(ctx, namespace, name)
+	if err != nil {
+		return nil, NoVersion, err
+	}
+	return route, ResourceVersion(route.GetRoute()), nil
+}
+
+// Set route if its current version is version, NoVersion requires it to not exist
+// Returns the UID and the new version, fails with ErrConflict if the version does not match
+func (communicator *StorageCommunicator) SetRouteIfVersion(ctx context.Context, namespace string, name string, route *protoStorage.Route, version string) (string, string, error) {
+	_, currentVersion, err := communicator.GetRouteWithVersion(ctx, namespace, name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", NoVersion, err
+	}
+	if err := checkVersion("SetRoute", namespace, name, version, currentVersion); err != nil {
+		return "", NoVersion, err
+	}
+
+	return communicator.writeRouteIfVersion(ctx, namespace, name, route, version)
+}
+
+// write route along with the expected version, without comparing it first
+func (communicator *StorageCommunicator) writeRouteIfVersion(ctx context.Context, namespace string, name string, route *protoStorage.Route, version string) (string, string, error) {
+	uid, err := communicator.SetRouteByNamespacedName(withExpectedVersion(ctx, version), namespace, name, route)
+	if err != nil {
+		return "", NoVersion, err
+	}
+	return uid, ResourceVersion(route), nil
+}
+
+// Read the route, pass it to update and write the result if the route was not changed meanwhile, otherwise start over
+// current is nil if the route does not exist, returning nil from update leaves the route unchanged
+func (communicator *StorageCommunicator) UpdateRoute(ctx context.Context, namespace string, name string, update func(current *protoStorage.Route) (*protoStorage.Route, error)) error {
+	return retryOnConflict(ctx, func() error {
+		current, version, err := communicator.GetRouteWithVersion(ctx, namespace, name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		var currentRoute *protoStorage.Route
+		if current != nil {
+			currentRoute = current.Route
+		}
+
+		updated, err := update(currentRoute)
+		if err != nil || updated == nil {
+			return err
+		}
+		// the version was just read, so it is not compared again
+		_, _, err = communicator.writeRouteIfVersion(ctx, namespace, name, updated, version)
+		return err
+	})
+}
+
+func (communicator *StorageCommunicator) GetServiceWithVersion(ctx context.Context, namespace string, name string) (*protoStorage.Service, string, error) {
+	service, err := communicator.GetService(ctx, namespace, name)
+	if err != nil {
+		return nil, NoVersion, err
+	}
+	return service, ResourceVersion(service), nil
+}
+
+// Set service if its current version is version, NoVersion requires it to not exist
+// Returns the new version, fails with ErrConflict if the version does not match
+func (communicator *StorageCommunicator) SetServiceIfVersion(ctx context.Context, namespace string, name string, service *protoStorage.Service, version string) (string, error) {
+	_, currentVersion, err := communicator.GetServiceWithVersion(ctx, namespace, name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return NoVersion, err
+	}
+	if err := checkVersion("SetService", namespace, name, version, currentVersion); err != nil {
+		return NoVersion, err
+	}
+
+	return communicator.writeServiceIfVersion(ctx, namespace, name, service, version)
+}
+
+func (communicator *StorageCommunicator) writeServiceIfVersion(ctx context.Context, namespace string, name string, service *protoStorage.Service, version string) (string, error) {
+	err := communicator.SetService(withExpectedVersion(ctx, version), namespace, name, service)
+	if err != nil {
+		return NoVersion, err
+	}
+	return ResourceVersion(service), nil
+}
+
+// Read the service, pass it to update and write the result if the service was not changed meanwhile, otherwise start over
+// current is nil if the service does not exist, returning nil from update leaves the service unchanged
+func (communicator *StorageCommunicator) UpdateService(ctx context.Context, namespace string, name string, update func(current *protoStorage.Service) (*protoStorage.Service, error)) error {
+	return retryOnConflict(ctx, func() error {
+		current, version, err := communicator.GetServiceWithVersion(ctx, namespace, name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		updated, err := update(current)
+		if err != nil || updated == nil {
+			return err
+		}
+		_, err = communicator.writeServiceIfVersion(ctx, namespace, name, updated, version)
+		return err
+	})
+}
+
+// Bypasses the cache, so the version is always up to date
+func (communicator *StorageCommunicator) GetServiceLBEndpointsWithVersion(ctx context.Context, namespace string, name string) ([]*protoCommon.Endpoint, string, error) {
+	endpoints, err := communicator.fetchServiceLBEndpoints(ctx, namespace, name)
+	if err != nil {
+		return nil, NoVersion, err
+	}
+	return endpoints, EndpointsVersion(endpoints), nil
+}
+
+// Set the LB endpoints of a service if their current version is version
+// Returns the new version, fails with ErrConflict if the version does not match
+func (communicator *StorageCommunicator) SetServiceLBEndpointsIfVersion(ctx context.Context, namespace string, name string, endpoints []*protoCommon.Endpoint, version string) (string, error) {
+	_, currentVersion, err := communicator.GetServiceLBEndpointsWithVersion(ctx, namespace, name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return NoVersion, err
+	}
+	if err := checkVersion("SetServiceLBEndpoints", namespace, name, version, currentVersion); err != nil {
+		return NoVersion, err
+	}
+
+	return communicator.writeServiceLBEndpointsIfVersion(ctx, namespace, name, endpoints, version)
+}
+
+func (communicator *StorageCommunicator) writeServiceLBEndpointsIfVersion(ctx context.Context, namespace string, name string, endpoints []*protoCommon.Endpoint, version string) (string, error) {
+	err := communicator.SetServiceLBEndpoints(withExpectedVersion(ctx, version), namespace, name, endpoints)
+	if err != nil {
+		return NoVersion, err
+	}
+	return EndpointsVersion(endpoints), nil
+}
+
+// Read the LB endpoints, pass them to update and write the result if they were not changed meanwhile, otherwise start over
+// returning nil from update leaves the endpoints unchanged, return an empty slice to remove all of them
+func (communicator *StorageCommunicator) UpdateServiceLBEndpoints(ctx context.Context, namespace string, name string, update func(current []*protoCommon.Endpoint) ([]*protoCommon.Endpoint, error)) error {
+	return retryOnConflict(ctx, func() error {
+		current, version, err := communicator.GetServiceLBEndpointsWithVersion(ctx, namespace, name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		updated, err := update(current)
+		if err != nil || updated == nil {
+			return err
+		}
+		_, err = communicator.writeServiceLBEndpointsIfVersion(ctx, namespace, name, updated, version)
+		return err
+	})
+}
+
+func retryOnConflict(ctx context.Context, attempt func() error) error {
+	b := updateRetryPolicy.newBackoff()
+	var err error
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err = attempt()
+		if !errors.Is(err, ErrConflict) || i == maxUpdateAttempts-1 {
+			return err
+		}
+
+		wait, _ := b.next()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+	return err
+}
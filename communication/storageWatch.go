@@ -0,0 +1,568 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultWatchInterval = 30 * time.Second
+const defaultWatchBufferSize = 16
+
+type ChangeType int
+
+const (
+	ChangeAdded ChangeType = iota
+	ChangeUpdated
+	ChangeDeleted
+)
+
+func (changeType ChangeType) String() string {
+	switch changeType {
+	case ChangeAdded:
+		return "Added"
+	case ChangeUpdated:
+		return "Updated"
+	case ChangeDeleted:
+		return "Deleted"
+	default:
+		return "Unknown"
+	}
+}
+
+// Deleted changes carry the last known route and version
+type RouteChange struct {
+	Type      ChangeType
+	Namespace string
+	Name      string
+	UID       string
+	Version   string
+	Route     *protoStorage.Route
+}
+
+// Deleted changes carry the last known service and version
+type ServiceChange struct {
+	Type      ChangeType
+	Namespace string
+	Name      string
+	Version   string
+	Service   *protoStorage.Service
+}
+
+// Services without LB endpoints are treated as if they did not exist:
+// removing all LB endpoints of a service results in a Deleted change carrying the last known ones
+type LBEndpointsChange struct {
+	Type      ChangeType
+	Namespace string
+	Name      string
+	Version   string
+	Endpoints []*protoCommon.Endpoint
+}
+
+type WatchOption func(*watchOptions)
+
+type watchOptions struct {
+	interval   time.Duration
+	bufferSize int
+}
+
+// How often all watched resources are listed even if no change was noticed, defaults to 30 seconds
+func WithWatchInterval(interval time.Duration) WatchOption {
+	return func(options *watchOptions) {
+		options.interval = interval
+	}
+}
+
+// Number of changes that can be queued on the channel, defaults to 16
+// The watch waits for the receiver if the channel is full
+func WithWatchBufferSize(size int) WatchOption {
+	return func(options *watchOptions) {
+		options.bufferSize = size
+	}
+}
+
+func newWatchOptions(opts []WatchOption) *watchOptions {
+	options := &watchOptions{
+		interval:   defaultWatchInterval,
+		bufferSize: defaultWatchBufferSize,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.interval <= 0 {
+		options.interval = defaultWatchInterval
+	}
+	if options.bufferSize < 0 {
+		options.bufferSize = 0
+	}
+	return options
+}
+
+// storageWatcher is resynchronized whenever a resource it watches might have changed
+type storageWatcher struct {
+	resourceType string
+	namespace    string
+	name         string
+	trigger      chan struct{}
+
+	// changes noticed since the watch last took them, they accumulate while it is fetching resources
+	mutex   sync.Mutex
+	changed map[string]bool
+	all     bool
+}
+
+// remember that resource changed and wake up the watch, nil makes it list all resources again
+func (watcher *storageWatcher) notify(resource *protoCommon.Resource) {
+	watcher.mutex.Lock()
+	if resource == nil {
+		watcher.all = true
+	} else {
+		watcher.changed[resource.Name] = true
+	}
+	watcher.mutex.Unlock()
+
+	select {
+	case watcher.trigger <- struct{}{}:
+	default:
+		// a resynchronization is pending already
+	}
+}
+
+// returns the names of the changed resources sorted and whether all resources have to be listed again
+func (watcher *storageWatcher) takeChanges() ([]string, bool) {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	names := make([]string, 0, len(watcher.changed))
+	for name := range watcher.changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	all := watcher.all
+	watcher.changed = make(map[string]bool)
+	watcher.all = false
+	return names, all
+}
+
+func (watcher *storageWatcher) matches(resource *protoCommon.Resource) bool {
+	if resource == nil {
+		return true
+	}
+	return resource.Type == watcher.resourceType &&
+		resource.Namespace == watcher.namespace &&
+		(watcher.name == "" || resource.Name == watcher.name)
+}
+
+type watchedResource struct {
+	namespace string
+	name      string
+	uid       string
+	version   string
+	value     interface{}
+}
+
+type resourceChange struct {
+	changeType ChangeType
+	resource   watchedResource
+}
+
+// Watch the routes of namespace or only the route name if it is not empty
+// The current routes are sent as Added changes first. Changes are noticed on writes of this communicator,
+// ConfigurationChanged events and by listing the routes regularly, so changes missed while the storage
+// or the control plane was unavailable are sent once it is reachable again. Writes and events only cause
+// the route they concern to be fetched again, while all routes are listed regularly and after failures.
+// The channel is closed once ctx is done.
+func (communicator *StorageCommunicator) WatchRoutes(ctx context.Context, namespace string, name string, opts ...WatchOption) (<-chan RouteChange, error) {
+	if namespace == "" {
+		return nil, newStorageError("WatchRoutes", namespace, name, status.Error(codes.InvalidArgument, "namespace is required"))
+	}
+	options := newWatchOptions(opts)
+	changes := make(chan RouteChange, options.bufferSize)
+
+	get := func(ctx context.Context, routeName string) (watchedResource, error) {
+		route, version, err := communicator.GetRouteWithVersion(ctx, namespace, routeName)
+		if err != nil {
+			return watchedResource{}, err
+		}
+		return watchedResource{namespace: namespace, name: routeName, uid: route.GetUid(), version: version, value: route.GetRoute()}, nil
+	}
+
+	list := func(ctx context.Context) (map[string]watchedResource, error) {
+		if name != "" {
+			return fetchWatched(ctx, []string{name}, get)
+		}
+
+		uids, err := communicator.GetRoutesInNamespace(ctx, namespace)
+		if err != nil {
+			return nil, err
+		}
+		resources := make(map[string]watchedResource, len(uids))
+		for _, uid := range uids {
+			route, err := communicator.GetRouteByUID(ctx, uid)
+			if errors.Is(err, ErrNotFound) {
+				// deleted after listing
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			routeName := route.GetName().GetName()
+			resources[routeName] = watchedResource{
+				namespace: namespace,
+				name:      routeName,
+				uid:       route.GetUid(),
+				version:   ResourceVersion(route.GetRoute()),
+				value:     route.GetRoute(),
+			}
+		}
+		return resources, nil
+	}
+
+	emit := func(change resourceChange) bool {
+		route, _ := change.resource.value.(*protoStorage.Route)
+		select {
+		case <-ctx.Done():
+			return false
+		case changes <- RouteChange{
+			Type:      change.changeType,
+			Namespace: change.resource.namespace,
+			Name:      change.resource.name,
+			UID:       change.resource.uid,
+			Version:   change.resource.version,
+			Route:     route,
+		}:
+			return true
+		}
+	}
+
+	communicator.startWatch(ctx, "routes", RouteResourceType, namespace, name, options, list, get, emit, func() { close(changes) })
+	return changes, nil
+}
+
+// Watch the services of namespace or only the service name if it is not empty, see WatchRoutes
+func (communicator *StorageCommunicator) WatchServices(ctx context.Context, namespace string, name string, opts ...WatchOption) (<-chan ServiceChange, error) {
+	if namespace == "" {
+		return nil, newStorageError("WatchServices", namespace, name, status.Error(codes.InvalidArgument, "namespace is required"))
+	}
+	options := newWatchOptions(opts)
+	changes := make(chan ServiceChange, options.bufferSize)
+
+	get := func(ctx context.Context, serviceName string) (watchedResource, error) {
+		service, version, err := communicator.GetServiceWithVersion(ctx, namespace, serviceName)
+		if err != nil {
+			return watchedResource{}, err
+		}
+		return watchedResource{namespace: namespace, name: serviceName, version: version, value: service}, nil
+	}
+
+	list := func(ctx context.Context) (map[string]watchedResource, error) {
+		return communicator.listWatchedServices(ctx, namespace, name, get)
+	}
+
+	emit := func(change resourceChange) bool {
+		service, _ := change.resource.value.(*protoStorage.Service)
+		select {
+		case <-ctx.Done():
+			return false
+		case changes <- ServiceChange{
+			Type:      change.changeType,
+			Namespace: change.resource.namespace,
+			Name:      change.resource.name,
+			Version:   change.resource.version,
+			Service:   service,
+		}:
+			return true
+		}
+	}
+
+	communicator.startWatch(ctx, "services", ServiceResourceType, namespace, name, options, list, get, emit, func() { close(changes) })
+	return changes, nil
+}
+
+// Watch the LB endpoints of the services of namespace or only of the service name if it is not empty, see WatchRoutes
+func (communicator *StorageCommunicator) WatchLBEndpoints(ctx context.Context, namespace string, name string, opts ...WatchOption) (<-chan LBEndpointsChange, error) {
+	if namespace == "" {
+		return nil, newStorageError("WatchLBEndpoints", namespace, name, status.Error(codes.InvalidArgument, "namespace is required"))
+	}
+	options := newWatchOptions(opts)
+	changes := make(chan LBEndpointsChange, options.bufferSize)
+
+	get := func(ctx context.Context, serviceName string) (watchedResource, error) {
+		endpoints, version, err := communicator.GetServiceLBEndpointsWithVersion(ctx, namespace, serviceName)
+		if err == nil && len(endpoints) == 0 {
+			err = newStorageError("GetServiceLBEndpoints", namespace, serviceName, status.Error(codes.NotFound, "service has no LB endpoints"))
+		}
+		if err != nil {
+			return watchedResource{}, err
+		}
+		return watchedResource{namespace: namespace, name: serviceName, version: version, value: endpoints}, nil
+	}
+
+	list := func(ctx context.Context) (map[string]watchedResource, error) {
+		return communicator.listWatchedServices(ctx, namespace, name, get)
+	}
+
+	emit := func(change resourceChange) bool {
+		endpoints, _ := change.resource.value.([]*protoCommon.Endpoint)
+		select {
+		case <-ctx.Done():
+			return false
+		case changes <- LBEndpointsChange{
+			Type:      change.changeType,
+			Namespace: change.resource.namespace,
+			Name:      change.resource.name,
+			Version:   change.resource.version,
+			Endpoints: endpoints,
+		}:
+			return true
+		}
+	}
+
+	communicator.startWatch(ctx, "LB endpoints", ServiceResourceType, namespace, name, options, list, get, emit, func() { close(changes) })
+	return changes, nil
+}
+
+// list service name or all services of namespace using get
+func (communicator *StorageCommunicator) listWatchedServices(ctx context.Context, namespace string, name string,
+	get func(ctx context.Context, name string) (watchedResource, error)) (map[string]watchedResource, error) {
+	names := []string{name}
+	if name == "" {
+		var err error
+		names, err = communicator.GetServicesInNamespace(ctx, namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fetchWatched(ctx, names, get)
+}
+
+// fetch the resources called names using get, resources for which get returns ErrNotFound are left out
+func fetchWatched(ctx context.Context, names []string, get func(ctx context.Context, name string) (watchedResource, error)) (map[string]watchedResource, error) {
+	resources := make(map[string]watchedResource, len(names))
+	for _, name := range names {
+		resource, err := get(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resources[name] = resource
+	}
+	return resources, nil
+}
+
+// watch the resources until ctx is done and emit the differences to the previously known ones
+// All resources are listed at first, regularly, when the readiness changes and after failures, otherwise only the
+// changed resources are fetched using get. emit returns false once ctx is done, done is called afterwards.
+func (communicator *StorageCommunicator) startWatch(ctx context.Context, kind string, resourceType string, namespace string, name string, options *watchOptions,
+	list func(ctx context.Context) (map[string]watchedResource, error), get func(ctx context.Context, name string) (watchedResource, error),
+	emit func(change resourceChange) bool, done func()) {
+	watcher := &storageWatcher{
+		resourceType: resourceType,
+		namespace:    namespace,
+		name:         name,
+		trigger:      make(chan struct{}, 1),
+		changed:      make(map[string]bool),
+	}
+	communicator.addWatcher(watcher)
+
+	Go("storage watch", func() {
+		defer done()
+		defer communicator.removeWatcher(watcher)
+
+		ticker := time.NewTicker(options.interval)
+		defer ticker.Stop()
+
+		known := make(map[string]watchedResource)
+		failing := false
+		listAll := true
+		for {
+			readinessChanged := communicator.ReadinessChanged()
+			// changes noticed while fetching are kept for the next iteration
+			changed, all := watcher.takeChanges()
+			listAll = listAll || all
+
+			var previous, current map[string]watchedResource
+			var err error
+			if listAll {
+				previous = known
+				current, err = list(ctx)
+			} else {
+				previous = make(map[string]watchedResource, len(changed))
+				for _, changedName := range changed {
+					if resource, ok := known[changedName]; ok {
+						previous[changedName] = resource
+					}
+				}
+				current, err = fetchWatched(ctx, changed, get)
+			}
+
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				if !failing {
+					logger.Warnw("could not fetch watched resources", "resources", kind, "namespace", namespace, "name", name, "error", err)
+				}
+				failing = true
+				// changes might be missed until the storage is reachable again
+				listAll = true
+			default:
+				if failing {
+					logger.Infow("resumed watching resources", "resources", kind, "namespace", namespace, "name", name)
+				}
+				failing = false
+				if !emitChanges(previous, current, emit) {
+					return
+				}
+				if listAll {
+					known = current
+				} else {
+					for _, changedName := range changed {
+						delete(known, changedName)
+						if resource, ok := current[changedName]; ok {
+							known[changedName] = resource
+						}
+					}
+				}
+				listAll = false
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-watcher.trigger:
+			case <-ticker.C:
+				listAll = true
+			case <-readinessChanged:
+				listAll = true
+			}
+		}
+	})
+}
+
+// emit the changes from previous to current sorted by name, returns false if emitting failed
+func emitChanges(previous map[string]watchedResource, current map[string]watchedResource, emit func(change resourceChange) bool) bool {
+	changes := make([]resourceChange, 0)
+	for key, resource := range current {
+		known, ok := previous[key]
+		switch {
+		case !ok:
+			changes = append(changes, resourceChange{changeType: ChangeAdded, resource: resource})
+		case known.version != resource.version || known.uid != resource.uid:
+			changes = append(changes, resourceChange{changeType: ChangeUpdated, resource: resource})
+		}
+	}
+	for key, resource := range previous {
+		if _, ok := current[key]; !ok {
+			changes = append(changes, resourceChange{changeType: ChangeDeleted, resource: resource})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].resource.name < changes[j].resource.name
+	})
+	for _, change := range changes {
+		if !emit(change) {
+			return false
+		}
+	}
+	return true
+}
+
+func (communicator *StorageCommunicator) addWatcher(watcher *storageWatcher) {
+	communicator.watchMutex.Lock()
+	if communicator.watchers == nil {
+		communicator.watchers = make(map[*storageWatcher]bool)
+	}
+	communicator.watchers[watcher] = true
+	communicator.watchMutex.Unlock()
+	communicator.acquireChanges()
+}
+
+func (communicator *StorageCommunicator) removeWatcher(watcher *storageWatcher) {
+	communicator.watchMutex.Lock()
+	delete(communicator.watchers, watcher)
+	communicator.watchMutex.Unlock()
+	communicator.releaseChanges()
+}
+
+// resynchronize the watches of resource, nil resynchronizes all of them
+func (communicator *StorageCommunicator) notifyWatchers(resource *protoCommon.Resource) {
+	communicator.watchMutex.Lock()
+	defer communicator.watchMutex.Unlock()
+	for watcher := range communicator.watchers {
+		if watcher.matches(resource) {
+			watcher.notify(resource)
+		}
+	}
+}
+
+// invalidate cached entries and resynchronize watches that might depend on resource, nil affects all of them
+func (communicator *StorageCommunicator) resourceChanged(resource *protoCommon.Resource) {
+	if resource != nil && resource.Namespace == LeaseNamespace {
+		// leases are neither cached nor watched
+		return
+	}
+	communicator.InvalidateCache(resource)
+	communicator.notifyWatchers(resource)
+}
+
+// subscribes to the changes of the storage, returns a function ending the subscription
+type changeSource func() (func(), error)
+
+// set the source of changes, it is subscribed to right away if the cache is enabled or resources are watched already
+func (communicator *StorageCommunicator) setChangeSource(source changeSource) {
+	communicator.changeMutex.Lock()
+	defer communicator.changeMutex.Unlock()
+	if communicator.unsubscribeChanges != nil {
+		communicator.unsubscribeChanges()
+		communicator.unsubscribeChanges = nil
+	}
+	communicator.changeSource = source
+	if communicator.changeConsumers > 0 {
+		communicator.subscribeChanges()
+	}
+}
+
+// the first consumer subscribes to the changes
+func (communicator *StorageCommunicator) acquireChanges() {
+	communicator.changeMutex.Lock()
+	defer communicator.changeMutex.Unlock()
+	communicator.changeConsumers++
+	if communicator.changeConsumers == 1 {
+		communicator.subscribeChanges()
+	}
+}
+
+// the last consumer ends the subscription
+func (communicator *StorageCommunicator) releaseChanges() {
+	communicator.changeMutex.Lock()
+	defer communicator.changeMutex.Unlock()
+	communicator.changeConsumers--
+	if communicator.changeConsumers == 0 && communicator.unsubscribeChanges != nil {
+		communicator.unsubscribeChanges()
+		communicator.unsubscribeChanges = nil
+	}
+}
+
+// has to be called while holding changeMutex
+func (communicator *StorageCommunicator) subscribeChanges() {
+	if communicator.changeSource == nil || communicator.unsubscribeChanges != nil {
+		return
+	}
+	unsubscribe, err := communicator.changeSource()
+	if err != nil {
+		// watches still list their resources regularly and cached entries expire after their TTL
+		logger.Warnw("Could not subscribe to configuration changes of the storage", "error", err)
+		return
+	}
+	communicator.unsubscribeChanges = unsubscribe
+}
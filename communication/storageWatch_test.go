@@ -0,0 +1,102 @@
+package communication_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+	protoStorage "github.com/kulycloud/protocol/storage"
+)
+
+func receiveRouteChange(t *testing.T, changes <-chan communication.RouteChange) communication.RouteChange {
+	t.Helper()
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(waitTimeout):
+		t.Fatal("no change received")
+		return communication.RouteChange{}
+	}
+}
+
+func TestWatchRoutesFetchesChangedRoutes(t *testing.T) {
+	storage := fake.NewStorage()
+	defer storage.Stop()
+	communicator, err := storage.Communicator()
+	if err != nil {
+		t.Fatalf("could not connect to storage: %v", err)
+	}
+	defer communicator.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := communicator.SetRouteByNamespacedName(ctx, "default", "existing", &protoStorage.Route{Host: "existing.com"}); err != nil {
+		t.Fatalf("could not set route: %v", err)
+	}
+	// routes are never listed regularly during the test, so changes are only noticed by fetching the written routes
+	changes, err := communicator.WatchRoutes(ctx, "default", "", communication.WithWatchInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("could not watch routes: %v", err)
+	}
+	if change := receiveRouteChange(t, changes); change.Type != communication.ChangeAdded || change.Name != "existing" {
+		t.Fatalf("unexpected change: %v %s", change.Type, change.Name)
+	}
+
+	if _, err := communicator.SetRouteByNamespacedName(ctx, "default", "created", &protoStorage.Route{Host: "created.com"}); err != nil {
+		t.Fatalf("could not set route: %v", err)
+	}
+	if change := receiveRouteChange(t, changes); change.Type != communication.ChangeAdded || change.Name != "created" {
+		t.Fatalf("unexpected change: %v %s", change.Type, change.Name)
+	}
+
+	if _, err := communicator.SetRouteByNamespacedName(ctx, "default", "existing", &protoStorage.Route{Host: "updated.com"}); err != nil {
+		t.Fatalf("could not set route: %v", err)
+	}
+	change := receiveRouteChange(t, changes)
+	if change.Type != communication.ChangeUpdated || change.Name != "existing" || change.Route.Host != "updated.com" {
+		t.Fatalf("unexpected change: %v %s", change.Type, change.Name)
+	}
+
+	if err := communicator.DeleteRoute(ctx, "default", "created"); err != nil {
+		t.Fatalf("could not delete route: %v", err)
+	}
+	change = receiveRouteChange(t, changes)
+	if change.Type != communication.ChangeDeleted || change.Name != "created" || change.Route.Host != "created.com" {
+		t.Fatalf("unexpected change: %v %s", change.Type, change.Name)
+	}
+
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected change: %v %s", change.Type, change.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStorageChangesAreOnlySubscribedWhileNeeded(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator, err := controlPlane.Register(context.Background(), "test", "localhost", 11, true)
+	if err != nil {
+		t.Fatalf("could not register: %v", err)
+	}
+	defer communicator.Close(context.Background())
+	subscribed := func() bool {
+		return listens(controlPlane, "localhost:11", communication.ConfigurationChangedEvent)
+	}
+	if subscribed() {
+		t.Fatal("subscribed to configuration changes without cache or watches")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := communicator.Storage.WatchServices(ctx, "default", ""); err != nil {
+		t.Fatalf("could not watch services: %v", err)
+	}
+	eventually(t, subscribed, "watch did not subscribe to configuration changes")
+	cancel()
+	eventually(t, func() bool { return !subscribed() }, "subscription outlived the last watch")
+
+	communicator.Storage.EnableCache(communication.CacheConfig{})
+	eventually(t, subscribed, "cache did not subscribe to configuration changes")
+}
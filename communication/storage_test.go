@@ -0,0 +1,176 @@
+package communication_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+	"github.com/kulycloud/common/security"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+)
+
+func connect(t *testing.T, storage *fake.Storage) *communication.StorageCommunicator {
+	t.Helper()
+	communicator, err := storage.Communicator()
+	if err != nil {
+		t.Fatalf("could not connect to storage: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = communicator.Close()
+	})
+	return communicator
+}
+
+func setEndpoints(t *testing.T, communicator *communication.StorageCommunicator, name string, port uint32) {
+	t.Helper()
+	endpoints := []*protoCommon.Endpoint{{Host: name, Port: port}}
+	if err := communicator.SetServiceLBEndpoints(context.Background(), "default", name, endpoints); err != nil {
+		t.Fatalf("could not set endpoints: %v", err)
+	}
+}
+
+func endpointPort(t *testing.T, communicator *communication.StorageCommunicator, name string) uint32 {
+	t.Helper()
+	endpoints, err := communicator.GetServiceLBEndpoints(context.Background(), "default", name)
+	if err != nil || len(endpoints) != 1 {
+		t.Fatalf("unexpected endpoints: %v, %v", endpoints, err)
+	}
+	return endpoints[0].Port
+}
+
+// port of the backend of the first step of the route
+func routeStartPort(t *testing.T, communicator *communication.StorageCommunicator) uint32 {
+	t.Helper()
+	start, err := communicator.GetRouteStart(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("could not get route start: %v", err)
+	}
+	endpoints := start.Step.GetEndpoints()
+	if len(endpoints) != 1 {
+		t.Fatalf("unexpected route start: %v", start)
+	}
+	return endpoints[0].Port
+}
+
+func TestCacheIsInvalidatedByServiceChanges(t *testing.T) {
+	storage := fake.NewStorage()
+	defer storage.Stop()
+	cached := connect(t, storage)
+	cached.EnableCache(communication.CacheConfig{})
+	// writes through another communicator are only noticed by invalidating the cache
+	writer := connect(t, storage)
+
+	route := &protoStorage.Route{
+		Host: "example.com",
+		Steps: []*protoStorage.RouteStep{
+			{Name: "backend", Config: "{}", Service: &protoStorage.NamespacedName{Namespace: "default", Name: "backend"}},
+		},
+	}
+	if _, err := writer.SetRouteByNamespacedName(context.Background(), "default", "example", route); err != nil {
+		t.Fatalf("could not set route: %v", err)
+	}
+	setEndpoints(t, writer, "backend", 1)
+	setEndpoints(t, writer, "backend2", 1)
+
+	if routeStartPort(t, cached) != 1 || endpointPort(t, cached, "backend") != 1 || endpointPort(t, cached, "backend2") != 1 {
+		t.Fatal("unexpected initial endpoints")
+	}
+	setEndpoints(t, writer, "backend", 2)
+	setEndpoints(t, writer, "backend2", 2)
+	if routeStartPort(t, cached) != 1 || endpointPort(t, cached, "backend") != 1 || endpointPort(t, cached, "backend2") != 1 {
+		t.Fatal("values were not cached")
+	}
+	hits := cached.CacheStats().Hits
+
+	cached.InvalidateCache(communication.NewResource(communication.ServiceResourceType, "default", "backend"))
+	if port := routeStartPort(t, cached); port != 2 {
+		t.Fatalf("route start still contains the endpoints of the changed service: %d", port)
+	}
+	if port := endpointPort(t, cached, "backend"); port != 2 {
+		t.Fatalf("endpoints of the changed service are still cached: %d", port)
+	}
+	// services sharing a prefix with the changed one are not affected
+	if port := endpointPort(t, cached, "backend2"); port != 1 {
+		t.Fatalf("endpoints of another service were invalidated: %d", port)
+	}
+	if stats := cached.CacheStats(); stats.Hits != hits+1 {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func startStorage(t *testing.T, address string, name string) *fake.Storage {
+	t.Helper()
+	storage, err := fake.NewStorageOnAddress(address)
+	if err != nil {
+		t.Fatalf("could not start storage: %v", err)
+	}
+	t.Cleanup(storage.Stop)
+	// the service tells which storage answered
+	if err := connect(t, storage).SetService(context.Background(), "default", "backend", &protoStorage.Service{Environment: map[string]string{"storage": name}}); err != nil {
+		t.Fatalf("could not set service: %v", err)
+	}
+	return storage
+}
+
+func answeredBy(t *testing.T, communicator *communication.StorageCommunicator) string {
+	t.Helper()
+	service, err := communicator.GetService(context.Background(), "default", "backend")
+	if err != nil {
+		t.Fatalf("could not get service: %v", err)
+	}
+	return service.Environment["storage"]
+}
+
+func TestStoragePoolFailsOverAndProbesEndpoints(t *testing.T) {
+	security.SetDefaultTransport(security.Insecure())
+	defer security.SetDefaultTransport(nil)
+	defer communication.SetStorageProbeInterval(50 * time.Millisecond)()
+
+	first := startStorage(t, "127.0.0.1:0", "first")
+	second := startStorage(t, "127.0.0.1:0", "second")
+	firstEndpoint := first.Endpoint()
+	communicator := communication.NewEmptyStorageCommunicator()
+	defer communicator.Close()
+	if err := communicator.SetEndpoints(context.Background(), []*protoCommon.Endpoint{firstEndpoint, second.Endpoint()}); err != nil {
+		t.Fatalf("could not set endpoints: %v", err)
+	}
+	if storage := answeredBy(t, communicator); storage != "first" {
+		t.Fatalf("expected the first storage to answer, got %s", storage)
+	}
+
+	// writes might have been applied already, so they are not retried on the next endpoint
+	first.Stop()
+	err := communicator.SetService(context.Background(), "default", "backend", &protoStorage.Service{})
+	if !errors.Is(err, communication.ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+	if storage := answeredBy(t, connect(t, second)); storage != "second" {
+		t.Fatal("write was retried on another endpoint")
+	}
+
+	// reads fail over to the next endpoint
+	if storage := answeredBy(t, communicator); storage != "second" {
+		t.Fatalf("expected the second storage to answer, got %s", storage)
+	}
+
+	second.Stop()
+	if _, err := communicator.GetService(context.Background(), "default", "backend"); !errors.Is(err, communication.ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+	if communicator.Ready() {
+		t.Fatal("storage is ready without a healthy endpoint")
+	}
+
+	// no calls are made meanwhile, so only probing finds out that the endpoint recovered
+	startStorage(t, net.JoinHostPort(firstEndpoint.Host, fmt.Sprint(firstEndpoint.Port)), "restarted")
+	eventually(t, communicator.Ready, "recovered endpoint was not marked healthy")
+	if storage := answeredBy(t, communicator); storage != "restarted" {
+		t.Fatalf("expected the restarted storage to answer, got %s", storage)
+	}
+}
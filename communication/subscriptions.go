@@ -0,0 +1,174 @@
+package communication
+
+import (
+	"context"
+	"sync"
+)
+
+// Subscription is returned when registering a handler and can be used to remove the handler again
+type Subscription struct {
+	communicator *ControlPlaneCommunicator
+	eventType    EventType
+	handler      EventHandler
+	once         sync.Once
+	queue        *eventQueue
+	metrics      SubscriptionMetrics
+	metricsMutex sync.Mutex
+	filters      []ResourceFilter
+	debouncer    *debouncer
+	replay       bool
+}
+
+func (subscription *Subscription) EventType() EventType {
+	return subscription.eventType
+}
+
+// Remove the handler
+// If it was the last handler for its event type the control plane is requested to stop sending the event type
+// Calling Unsubscribe more than once is a no-op
+func (subscription *Subscription) Unsubscribe() error {
+	var err error
+	subscription.once.Do(func() {
+		err = subscription.communicator.unsubscribe(subscription)
+	})
+	return err
+}
+
+// requests control plane to listen on eventType and adds handler afterwards
+// handler receives events decoded by the decoder registered for eventType, see RegisterEventType
+// every subscription has its own queue and worker, so a slow handler does not delay other handlers
+func (communicator *ControlPlaneCommunicator) Subscribe(eventType EventType, handler EventHandler, opts ...SubscribeOption) (*Subscription, error) {
+	options := newSubscribeOptions(opts)
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	communicator.listenMutex.Lock()
+	defer communicator.listenMutex.Unlock()
+
+	request := newListenToEventRequest(communicator.identifier, eventType)
+	_, err := communicator.controlPlaneClient.ListenToEvent(context.Background(), request)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := &Subscription{
+		communicator: communicator,
+		eventType:    eventType,
+		handler:      handler,
+		queue:        newEventQueue(options.queueSize, options.overflowPolicy),
+		filters:      options.filters,
+		replay:       options.replay,
+	}
+	if options.debounceWindow > 0 {
+		subscription.debouncer = newDebouncer(options.debounceWindow, options.debounceMaxDelay, subscription.queue.push)
+	}
+	communicator.background.Add(1)
+	Go("event handler", func() {
+		defer communicator.background.Done()
+		subscription.work()
+	})
+
+	communicator.subscriptionsMutex.Lock()
+	communicator.subscriptions[eventType] = append(communicator.subscriptions[eventType], subscription)
+	if options.replay {
+		communicator.addReplay(eventType)
+		subscription.queue.prefill(subscription.acceptedEvents(communicator.lastEventsOfType(eventType)))
+	}
+	communicator.subscriptionsMutex.Unlock()
+	return subscription, nil
+}
+
+func (communicator *ControlPlaneCommunicator) unsubscribe(subscription *Subscription) error {
+	communicator.listenMutex.Lock()
+	defer communicator.listenMutex.Unlock()
+
+	communicator.subscriptionsMutex.Lock()
+	current := communicator.subscriptions[subscription.eventType]
+	// copy instead of removing in place, processEvent may still iterate the old slice
+	remaining := make([]*Subscription, 0, len(current))
+	for _, s := range current {
+		if s != subscription {
+			remaining = append(remaining, s)
+		}
+	}
+	if len(remaining) > 0 {
+		communicator.subscriptions[subscription.eventType] = remaining
+	} else {
+		delete(communicator.subscriptions, subscription.eventType)
+	}
+	if subscription.replay && len(remaining) < len(current) {
+		communicator.removeReplay(subscription.eventType)
+	}
+	communicator.subscriptionsMutex.Unlock()
+	subscription.stop()
+
+	if len(remaining) > 0 || len(current) == 0 {
+		return nil
+	}
+	_, err := communicator.controlPlaneClient.CreateEvent(context.Background(), newStopListeningToEvent(communicator.identifier, subscription.eventType))
+	return err
+}
+
+// Set handler that receives events of types no decoder is registered for
+// The events are passed as *RawEvent, subscriptions for their type are notified as well
+func (communicator *ControlPlaneCommunicator) SetFallbackHandler(handler EventHandler, opts ...SubscribeOption) {
+	options := newSubscribeOptions(opts)
+	fallback := &Subscription{
+		communicator: communicator,
+		handler:      handler,
+		queue:        newEventQueue(options.queueSize, options.overflowPolicy),
+	}
+	communicator.background.Add(1)
+	Go("fallback event handler", func() {
+		defer communicator.background.Done()
+		fallback.work()
+	})
+
+	communicator.subscriptionsMutex.Lock()
+	previous := communicator.fallback
+	communicator.fallback = fallback
+	communicator.subscriptionsMutex.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+}
+
+func (communicator *ControlPlaneCommunicator) getFallback() *Subscription {
+	communicator.subscriptionsMutex.RLock()
+	defer communicator.subscriptionsMutex.RUnlock()
+	return communicator.fallback
+}
+
+// remembers event and returns the subscriptions for its type, the returned slice is never modified
+// both happens at once, so subscriptions registered afterwards replay event instead of receiving it
+func (communicator *ControlPlaneCommunicator) recordEvent(event Event) []*Subscription {
+	communicator.subscriptionsMutex.Lock()
+	defer communicator.subscriptionsMutex.Unlock()
+	communicator.rememberEvent(event)
+	return communicator.subscriptions[event.GetType()]
+}
+
+// stop the workers of all subscriptions without notifying the control plane
+func (communicator *ControlPlaneCommunicator) stopSubscriptions() {
+	communicator.subscriptionsMutex.Lock()
+	defer communicator.subscriptionsMutex.Unlock()
+	for _, subscriptions := range communicator.subscriptions {
+		for _, subscription := range subscriptions {
+			subscription.stop()
+		}
+	}
+	if communicator.fallback != nil {
+		communicator.fallback.stop()
+	}
+}
+
+func (communicator *ControlPlaneCommunicator) registeredEventTypes() []EventType {
+	communicator.subscriptionsMutex.RLock()
+	defer communicator.subscriptionsMutex.RUnlock()
+	eventTypes := make([]EventType, 0, len(communicator.subscriptions))
+	for eventType := range communicator.subscriptions {
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes
+}
@@ -0,0 +1,173 @@
+package communication_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/communication/fake"
+)
+
+const waitTimeout = 5 * time.Second
+
+func register(t *testing.T, controlPlane *fake.ControlPlane, port uint32) *communication.ControlPlaneCommunicator {
+	t.Helper()
+	communicator, err := controlPlane.Register(context.Background(), "test", "localhost", port, false)
+	if err != nil {
+		t.Fatalf("could not register: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = communicator.Close(context.Background())
+	})
+	return communicator
+}
+
+func eventually(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func listens(controlPlane *fake.ControlPlane, identifier string, eventType communication.EventType) bool {
+	for _, component := range controlPlane.Components() {
+		if component.Identifier != identifier {
+			continue
+		}
+		for _, listened := range component.Listens {
+			if listened == eventType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestSubscribeAndUnsubscribeWhileProcessingEvents(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, 1)
+
+	// keeps the event type subscribed, so the control plane forwards events the whole time
+	var delivered int64
+	permanent, err := communicator.Subscribe(communication.ConfigurationChangedEvent, func(communication.Event) {
+		atomic.AddInt64(&delivered, 1)
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	done := make(chan struct{})
+	var pushers sync.WaitGroup
+	pushers.Add(1)
+	go func() {
+		defer pushers.Done()
+		event := communication.NewConfigurationChanged(communication.NewResource("route", "default", "example")).ToGrpcEvent()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			controlPlane.Push(event)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var subscribers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			for j := 0; j < 20; j++ {
+				subscription, err := communicator.Subscribe(communication.ConfigurationChangedEvent, func(communication.Event) {})
+				if err != nil {
+					t.Errorf("could not subscribe: %v", err)
+					return
+				}
+				if err := subscription.Unsubscribe(); err != nil {
+					t.Errorf("could not unsubscribe: %v", err)
+					return
+				}
+				// unsubscribing again is a no-op
+				if err := subscription.Unsubscribe(); err != nil {
+					t.Errorf("unsubscribing twice failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	subscribers.Wait()
+	close(done)
+	pushers.Wait()
+
+	eventually(t, func() bool { return atomic.LoadInt64(&delivered) > 0 }, "no event was delivered")
+	if !listens(controlPlane, "localhost:1", communication.ConfigurationChangedEvent) {
+		t.Fatal("control plane stopped sending events while a subscription is left")
+	}
+	if err := permanent.Unsubscribe(); err != nil {
+		t.Fatalf("could not unsubscribe: %v", err)
+	}
+}
+
+func TestLastUnsubscribeStopsListening(t *testing.T) {
+	controlPlane := fake.NewControlPlane()
+	defer controlPlane.Stop()
+	communicator := register(t, controlPlane, 2)
+
+	first, err := communicator.Subscribe(communication.ClusterChangedEvent, func(communication.Event) {})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	var delivered int64
+	last, err := communicator.Subscribe(communication.ClusterChangedEvent, func(communication.Event) {
+		atomic.AddInt64(&delivered, 1)
+	})
+	if err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	if err := first.Unsubscribe(); err != nil {
+		t.Fatalf("could not unsubscribe: %v", err)
+	}
+	if !listens(controlPlane, "localhost:2", communication.ClusterChangedEvent) {
+		t.Fatal("stopped listening although a subscription is left")
+	}
+	if count := stopListeningEvents(controlPlane); count != 0 {
+		t.Fatalf("expected no StopListeningToEvent event, got %d", count)
+	}
+
+	if err := last.Unsubscribe(); err != nil {
+		t.Fatalf("could not unsubscribe: %v", err)
+	}
+	if count := stopListeningEvents(controlPlane); count != 1 {
+		t.Fatalf("expected a single StopListeningToEvent event, got %d", count)
+	}
+	if listens(controlPlane, "localhost:2", communication.ClusterChangedEvent) {
+		t.Fatal("control plane still sends events nobody is subscribed to")
+	}
+
+	controlPlane.Push(communication.NewClusterChanged(communication.NewResource("cluster", "", "default"), nil, nil).ToGrpcEvent())
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt64(&delivered) != 0 {
+		t.Fatal("event was delivered to an unsubscribed handler")
+	}
+}
+
+func stopListeningEvents(controlPlane *fake.ControlPlane) int {
+	count := 0
+	for _, event := range controlPlane.CreatedEvents() {
+		if communication.EventType(event.Type) == communication.StopListeningToEventEvent &&
+			event.GetConfigurationChanged().GetResource().GetType() == string(communication.ClusterChangedEvent) {
+			count++
+		}
+	}
+	return count
+}
@@ -8,4 +8,5 @@ require (
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.16.0
 	google.golang.org/grpc v1.32.0
+	google.golang.org/protobuf v1.25.0
 )
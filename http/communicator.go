@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/kulycloud/common/communication"
+	"github.com/kulycloud/common/security"
 	protoCommon "github.com/kulycloud/protocol/common"
 	protoHttp "github.com/kulycloud/protocol/http"
 )
@@ -31,7 +32,7 @@ type Metrics struct {
 var ErrNoSuitableEndpoint = errors.New("no suitable endpoint found")
 
 func NewCommunicatorFromEndpoint(ctx context.Context, endpoint *protoCommon.Endpoint, withMetrics bool) (*Communicator, error) {
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%v", endpoint.Host, endpoint.Port), grpc.WithInsecure())
+	conn, err := security.Dial(fmt.Sprintf("%s:%v", endpoint.Host, endpoint.Port), nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not create connection to component: %w", err)
 	}
@@ -43,8 +44,12 @@ func NewCommunicatorFromEndpoint(ctx context.Context, endpoint *protoCommon.Endp
 	if withMetrics {
 		communicator.metrics = &Metrics{}
 		err = communicator.Ping(ctx)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
 	}
-	return communicator, err
+	return communicator, nil
 }
 
 // create valid communicators for endpoints
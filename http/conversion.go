@@ -2,8 +2,10 @@ package http
 
 import (
 	"errors"
-	protoHttp "github.com/kulycloud/protocol/http"
 	"io"
+
+	"github.com/kulycloud/common/communication"
+	protoHttp "github.com/kulycloud/protocol/http"
 )
 
 var ErrConversionError = errors.New("error during conversion")
@@ -115,6 +117,7 @@ func (bw *body) connectStream(stream grpcStream) errorChannel {
 	bw.connectedToStream = true
 	errCh := make(errorChannel, 1)
 	go func() {
+		defer communication.RecoverPanic("receive body")
 		defer func() {
 			close(bw.backlog)
 			close(errCh)
@@ -143,6 +146,7 @@ func (bw *body) toStream(stream grpcStream) errorChannel {
 	errCh := make(errorChannel)
 	var err error
 	go func() {
+		defer communication.RecoverPanic("send body")
 		defer func() {
 			close(errCh)
 		}()
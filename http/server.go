@@ -8,7 +8,9 @@ import (
 	"google.golang.org/grpc"
 	"net"
 
+	"github.com/kulycloud/common/communication"
 	"github.com/kulycloud/common/logging"
+	"github.com/kulycloud/common/security"
 	protoHttp "github.com/kulycloud/protocol/http"
 )
 
@@ -21,9 +23,11 @@ var logger = logging.GetForComponent("http")
 type httpHandler struct {
 	protoHttp.UnimplementedHttpServer
 	handlerFunc HandlerFunc
+	requests    communication.RequestCounter
 }
 
 type Server struct {
+	Health   *communication.HealthRegistry
 	handler  *httpHandler
 	server   *grpc.Server
 	listener net.Listener
@@ -40,6 +44,8 @@ func (server *httpHandler) Ping(_ context.Context, _ *protoCommon.Empty) (*proto
 }
 
 func (server *httpHandler) ProcessRequest(grpcStream protoHttp.Http_ProcessRequestServer) error {
+	server.requests.Start()
+	defer server.requests.Done()
 	request := NewRequest()
 	err, recvErrs := receive(grpcStream, request)
 	if err != nil {
@@ -60,6 +66,7 @@ func (server *httpHandler) ProcessRequest(grpcStream protoHttp.Http_ProcessReque
 func NewServer(httpPort uint32, handlerFunc HandlerFunc) (*Server, error) {
 	handler := newHttpHandler(handlerFunc)
 	server := &Server{
+		Health:  communication.NewHealthRegistry(),
 		handler: handler,
 	}
 	err := server.setup(httpPort, handler)
@@ -75,14 +82,35 @@ func (hs *Server) setup(port uint32, handler *httpHandler) error {
 	if err != nil {
 		return err
 	}
+	server, err := security.NewServer(nil,
+		grpc.ChainUnaryInterceptor(communication.UnaryPanicInterceptor),
+		grpc.ChainStreamInterceptor(communication.StreamPanicInterceptor),
+	)
+	if err != nil {
+		_ = lis.Close()
+		return err
+	}
 	hs.listener = lis
-	hs.server = grpc.NewServer()
+	hs.server = server
 	logger.Infow("created server", "port", port)
 	protoHttp.RegisterHttpServer(hs.server, handler)
+	hs.Health.Register(hs.server)
 	return nil
 }
 
+// Contributes the number of requests currently being processed, use it as communication.StatusProvider
+func (hs *Server) ProvideStatus(status *communication.Status) {
+	hs.handler.requests.Provide(status)
+}
+
+// Report NOT_SERVING and stop the server once pending requests are finished
+func (hs *Server) Stop() {
+	hs.Health.Shutdown()
+	hs.server.GracefulStop()
+}
+
 func (hs *Server) Serve() error {
+	defer communication.RecoverPanic("serve http")
 	logger.Infow("serving")
 	err := hs.server.Serve(hs.listener)
 	return err
@@ -0,0 +1,232 @@
+package security
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var ErrInvalidAuthConfig = errors.New("invalid auth config")
+var ErrUnauthenticated = errors.New("caller could not be authenticated")
+
+const (
+	authorizationMetadataKey = "authorization"
+	secretScheme             = "Secret "
+	tokenScheme              = "Token "
+	defaultTokenTTL          = 5 * time.Minute
+	// health checks are performed by probes that cannot authenticate
+	healthMethodPrefix = "/grpc.health.v1.Health/"
+)
+
+// AuthConfig can be populated by config.Parser
+type AuthConfig struct {
+	// shared between all components, leave the default auth unset to disable authentication
+	Secret string `configName:"authSecret" defaultValue:""`
+	// send the secret itself instead of short-lived tokens signed with it, only meant for peers that cannot verify tokens
+	SendSecret bool `configName:"authSendSecret" defaultValue:"false"`
+}
+
+// Identity of an authenticated component
+// The identity is asserted by the caller itself, authentication only proves that the caller knows the shared secret
+// Use client certificates (TransportConfig.RequireClientCert) if components must not be able to impersonate each other
+type Identity struct {
+	Type string
+	Name string
+}
+
+// Auth authenticates this component to others and verifies callers of its servers
+// It is used as per-RPC credentials by Dial and as interceptor by NewServer once set as default
+type Auth struct {
+	secret     []byte
+	sendSecret bool
+	tokenTTL   time.Duration
+
+	identity      Identity
+	identityMutex sync.RWMutex
+}
+
+var _ credentials.PerRPCCredentials = &Auth{}
+
+func NewAuth(config AuthConfig) (*Auth, error) {
+	if config.Secret == "" {
+		return nil, fmt.Errorf("%w: secret must not be empty", ErrInvalidAuthConfig)
+	}
+	return &Auth{
+		secret:     []byte(config.Secret),
+		sendSecret: config.SendSecret,
+		tokenTTL:   defaultTokenTTL,
+	}, nil
+}
+
+var (
+	defaultAuth      *Auth
+	defaultAuthMutex sync.RWMutex
+)
+
+// Set the auth used by all connections and servers of this library, nil disables authentication
+// Credentials are only sent over TLS, Dial and NewServer return ErrInvalidAuthConfig for insecure transports
+func SetDefaultAuth(auth *Auth) {
+	defaultAuthMutex.Lock()
+	defer defaultAuthMutex.Unlock()
+	defaultAuth = auth
+}
+
+func DefaultAuth() *Auth {
+	defaultAuthMutex.RLock()
+	defer defaultAuthMutex.RUnlock()
+	return defaultAuth
+}
+
+// Set the identity this component presents to others
+// This is done by ControlPlaneCommunicator when registering
+func (auth *Auth) SetIdentity(identity Identity) {
+	auth.identityMutex.Lock()
+	defer auth.identityMutex.Unlock()
+	auth.identity = identity
+}
+
+func (auth *Auth) getIdentity() Identity {
+	auth.identityMutex.RLock()
+	defer auth.identityMutex.RUnlock()
+	return auth.identity
+}
+
+func (auth *Auth) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	identity := auth.getIdentity()
+	if auth.sendSecret {
+		return map[string]string{
+			authorizationMetadataKey: secretScheme + string(auth.secret) + " " + encodeIdentity(identity),
+		}, nil
+	}
+	payload := fmt.Sprintf("%s %d", encodeIdentity(identity), time.Now().Add(auth.tokenTTL).Unix())
+	return map[string]string{
+		authorizationMetadataKey: tokenScheme + payload + " " + auth.sign(payload),
+	}, nil
+}
+
+// neither the secret nor tokens may be sent in plaintext, tokens could be replayed until they expire
+func (auth *Auth) RequireTransportSecurity() bool {
+	return true
+}
+
+// Verify the credentials sent by the caller
+func (auth *Auth) Authenticate(ctx context.Context) (*Identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationMetadataKey)
+	if len(values) != 1 {
+		return nil, fmt.Errorf("%w: missing credentials", ErrUnauthenticated)
+	}
+	value := values[0]
+
+	switch {
+	case strings.HasPrefix(value, secretScheme):
+		// the secret may contain spaces, the identity is encoded and cannot
+		rest := strings.TrimPrefix(value, secretScheme)
+		separator := strings.LastIndex(rest, " ")
+		if separator < 0 || subtle.ConstantTimeCompare([]byte(rest[:separator]), auth.secret) != 1 {
+			return nil, fmt.Errorf("%w: invalid secret", ErrUnauthenticated)
+		}
+		return decodeIdentity(rest[separator+1:])
+	case strings.HasPrefix(value, tokenScheme):
+		parts := strings.Split(strings.TrimPrefix(value, tokenScheme), " ")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+		}
+		payload := parts[0] + " " + parts[1]
+		if !hmac.Equal([]byte(parts[2]), []byte(auth.sign(payload))) {
+			return nil, fmt.Errorf("%w: invalid token signature", ErrUnauthenticated)
+		}
+		expiry, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || time.Now().Unix() > expiry {
+			return nil, fmt.Errorf("%w: token expired", ErrUnauthenticated)
+		}
+		return decodeIdentity(parts[0])
+	default:
+		return nil, fmt.Errorf("%w: unknown authorization scheme", ErrUnauthenticated)
+	}
+}
+
+func (auth *Auth) sign(payload string) string {
+	mac := hmac.New(sha256.New, auth.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func encodeIdentity(identity Identity) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(identity.Type + "/" + identity.Name))
+}
+
+func decodeIdentity(encoded string) (*Identity, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed identity", ErrUnauthenticated)
+	}
+	parts := strings.SplitN(string(raw), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: malformed identity", ErrUnauthenticated)
+	}
+	return &Identity{Type: parts[0], Name: parts[1]}, nil
+}
+
+type identityContextKey struct{}
+
+// Returns the identity of the authenticated caller, handlers of servers created by NewServer receive it
+// Returns false if authentication is disabled
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(*Identity)
+	return identity, ok
+}
+
+func (auth *Auth) authenticateContext(ctx context.Context) (context.Context, error) {
+	identity, err := auth.Authenticate(ctx)
+	if err != nil {
+		logger.Warnw("rejected unauthenticated call", "error", err)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return context.WithValue(ctx, identityContextKey{}, identity), nil
+}
+
+func (auth *Auth) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+		return handler(ctx, req)
+	}
+	ctx, err := auth.authenticateContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (auth *Auth) StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+		return handler(srv, stream)
+	}
+	ctx, err := auth.authenticateContext(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *authenticatedStream) Context() context.Context {
+	return stream.ctx
+}
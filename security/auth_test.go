@@ -0,0 +1,177 @@
+package security
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newTestAuth(t *testing.T, config AuthConfig) *Auth {
+	t.Helper()
+	auth, err := NewAuth(config)
+	if err != nil {
+		t.Fatalf("could not create auth: %v", err)
+	}
+	auth.SetIdentity(Identity{Type: "worker", Name: "localhost:8/a"})
+	return auth
+}
+
+// returns a context as a server receives it from a caller using auth
+func incomingContext(t *testing.T, auth *Auth) context.Context {
+	t.Helper()
+	md, err := auth.GetRequestMetadata(context.Background())
+	if err != nil {
+		t.Fatalf("could not get request metadata: %v", err)
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.New(md))
+}
+
+func withAuthorization(value string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(authorizationMetadataKey, value))
+}
+
+func TestSignedTokensAuthenticateTheCaller(t *testing.T) {
+	auth := newTestAuth(t, AuthConfig{Secret: "secret"})
+	md, _ := auth.GetRequestMetadata(context.Background())
+	if strings.Contains(md[authorizationMetadataKey], "secret") {
+		t.Fatalf("token contains the secret: %s", md[authorizationMetadataKey])
+	}
+
+	identity, err := auth.Authenticate(incomingContext(t, auth))
+	if err != nil {
+		t.Fatalf("could not authenticate: %v", err)
+	}
+	if identity.Type != "worker" || identity.Name != "localhost:8/a" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	other := newTestAuth(t, AuthConfig{Secret: "other"})
+	if _, err := other.Authenticate(incomingContext(t, auth)); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("token signed with another secret was accepted: %v", err)
+	}
+}
+
+func TestModifiedAndExpiredTokensAreRejected(t *testing.T) {
+	auth := newTestAuth(t, AuthConfig{Secret: "secret"})
+	md, _ := auth.GetRequestMetadata(context.Background())
+	parts := strings.Split(strings.TrimPrefix(md[authorizationMetadataKey], tokenScheme), " ")
+
+	extended := tokenScheme + parts[0] + " " + "9999999999" + " " + parts[2]
+	impersonated := tokenScheme + encodeIdentity(Identity{Type: "control-plane", Name: "x"}) + " " + parts[1] + " " + parts[2]
+	for _, value := range []string{extended, impersonated, tokenScheme + parts[0] + " " + parts[1]} {
+		if _, err := auth.Authenticate(withAuthorization(value)); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("modified token %q was accepted: %v", value, err)
+		}
+	}
+
+	auth.tokenTTL = -time.Minute
+	if _, err := auth.Authenticate(incomingContext(t, auth)); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("expired token was accepted: %v", err)
+	}
+}
+
+func TestSecretsAreParsed(t *testing.T) {
+	auth := newTestAuth(t, AuthConfig{Secret: "secret with spaces", SendSecret: true})
+	identity, err := auth.Authenticate(incomingContext(t, auth))
+	if err != nil {
+		t.Fatalf("could not authenticate: %v", err)
+	}
+	if identity.Type != "worker" || identity.Name != "localhost:8/a" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	invalid := []string{
+		secretScheme + "secret with " + encodeIdentity(Identity{Type: "worker"}),
+		secretScheme + "secret with spaces",
+		secretScheme + "secret with spaces !invalid!",
+		"Bearer secret with spaces",
+	}
+	for _, value := range invalid {
+		if _, err := auth.Authenticate(withAuthorization(value)); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("authorization %q was accepted: %v", value, err)
+		}
+	}
+	if _, err := auth.Authenticate(context.Background()); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("missing credentials were accepted: %v", err)
+	}
+
+	if _, err := NewAuth(AuthConfig{}); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("expected ErrInvalidAuthConfig for an empty secret, got %v", err)
+	}
+}
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *testStream) Context() context.Context {
+	return stream.ctx
+}
+
+func TestInterceptorsAuthenticateCalls(t *testing.T) {
+	auth := newTestAuth(t, AuthConfig{Secret: "secret"})
+	var identity *Identity
+	unary := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		identity, _ = IdentityFromContext(ctx)
+		return nil, nil
+	}
+	stream := func(_ interface{}, stream grpc.ServerStream) error {
+		identity, _ = IdentityFromContext(stream.Context())
+		return nil
+	}
+	callUnary := func(ctx context.Context, method string) error {
+		identity = nil
+		_, err := auth.UnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, unary)
+		return err
+	}
+	callStream := func(ctx context.Context, method string) error {
+		identity = nil
+		return auth.StreamInterceptor(nil, &testStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method}, stream)
+	}
+
+	for name, call := range map[string]func(context.Context, string) error{"unary": callUnary, "stream": callStream} {
+		if err := call(context.Background(), "/test.Service/Call"); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("%s: expected Unauthenticated, got %v", name, err)
+		}
+		if err := call(incomingContext(t, auth), "/test.Service/Call"); err != nil || identity == nil || identity.Type != "worker" {
+			t.Fatalf("%s: authenticated call failed: %v, %+v", name, err, identity)
+		}
+		// probes cannot authenticate
+		if err := call(context.Background(), healthMethodPrefix+"Check"); err != nil || identity != nil {
+			t.Fatalf("%s: health check was not let through unauthenticated: %v, %+v", name, err, identity)
+		}
+	}
+}
+
+func TestAuthRequiresSecureTransport(t *testing.T) {
+	SetDefaultAuth(newTestAuth(t, AuthConfig{Secret: "secret"}))
+	defer SetDefaultAuth(nil)
+
+	if _, err := Dial("localhost:1", Insecure()); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("expected ErrInvalidAuthConfig when dialing, got %v", err)
+	}
+	if _, err := NewServer(Insecure()); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("expected ErrInvalidAuthConfig when creating a server, got %v", err)
+	}
+
+	// the health service stays reachable over TLS, the credentials are sent but not required
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caFile := ca.writeCA(t, filepath.Join(dir, "ca.crt"))
+	certFile, keyFile := ca.issue(t, dir, x509.ExtKeyUsageServerAuth, []string{"localhost"})
+	port := serve(t, newTestTransport(t, TransportConfig{CertFile: certFile, KeyFile: keyFile}))
+	if err := check(t, net.JoinHostPort("localhost", port), newTestTransport(t, TransportConfig{CAFile: caFile})); err != nil {
+		t.Fatalf("could not call server: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package security
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kulycloud/common/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var logger = logging.GetForComponent("common-security")
+
+var ErrTransportNotConfigured = errors.New("transport security not configured, configure TLS or opt in to insecure connections")
+var ErrInvalidTransportConfig = errors.New("invalid transport config")
+
+// files are checked for rotation at most this often
+const reloadCheckInterval = 10 * time.Second
+
+// TransportConfig can be populated by config.Parser
+type TransportConfig struct {
+	// plaintext connections, has to be enabled explicitly
+	Insecure bool `configName:"tlsInsecure" defaultValue:"false"`
+	// certificate presented to peers, required for servers and mutual TLS
+	CertFile string `configName:"tlsCertFile" defaultValue:""`
+	KeyFile  string `configName:"tlsKeyFile" defaultValue:""`
+	// CA bundle used to verify peers, the system roots are used for servers if empty
+	CAFile string `configName:"tlsCaFile" defaultValue:""`
+	// servers require and verify client certificates
+	RequireClientCert bool `configName:"tlsRequireClientCert" defaultValue:"false"`
+	// overrides the name servers are verified against, defaults to the dialed host
+	ServerName string `configName:"tlsServerName" defaultValue:""`
+}
+
+// Transport creates client and server credentials from a TransportConfig
+// Certificates and the CA bundle are reloaded when the files change
+type Transport struct {
+	config TransportConfig
+	files  *fileStore
+}
+
+func NewTransport(config TransportConfig) (*Transport, error) {
+	if config.Insecure {
+		return &Transport{config: config}, nil
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("%w: certificate and key have to be set together", ErrInvalidTransportConfig)
+	}
+	if config.RequireClientCert && config.CAFile == "" {
+		return nil, fmt.Errorf("%w: verifying client certificates requires a CA bundle", ErrInvalidTransportConfig)
+	}
+
+	files := &fileStore{certFile: config.CertFile, keyFile: config.KeyFile, caFile: config.CAFile}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+	return &Transport{config: config, files: files}, nil
+}
+
+// Transport without any security, only use it in trusted networks
+func Insecure() *Transport {
+	return &Transport{config: TransportConfig{Insecure: true}}
+}
+
+var (
+	defaultTransport      *Transport
+	defaultTransportMutex sync.RWMutex
+)
+
+// Set the transport used by all connections and servers of this library that are not configured explicitly
+// Components have to set it on startup, SetDefaultTransport(Insecure()) opts in to plaintext connections
+func SetDefaultTransport(transport *Transport) {
+	defaultTransportMutex.Lock()
+	defer defaultTransportMutex.Unlock()
+	defaultTransport = transport
+}
+
+// Returns the transport set by SetDefaultTransport or ErrTransportNotConfigured if none was set
+func DefaultTransport() (*Transport, error) {
+	defaultTransportMutex.RLock()
+	defer defaultTransportMutex.RUnlock()
+	if defaultTransport == nil {
+		return nil, ErrTransportNotConfigured
+	}
+	return defaultTransport, nil
+}
+
+func orDefault(transport *Transport) (*Transport, error) {
+	if transport != nil {
+		return transport, nil
+	}
+	return DefaultTransport()
+}
+
+func (transport *Transport) DialOption() grpc.DialOption {
+	if transport.config.Insecure {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(&clientCredentials{transport: transport, serverName: transport.config.ServerName})
+}
+
+func (transport *Transport) ServerOptions() ([]grpc.ServerOption, error) {
+	if transport.config.Insecure {
+		return nil, nil
+	}
+	if transport.config.CertFile == "" {
+		return nil, fmt.Errorf("%w: servers require a certificate", ErrInvalidTransportConfig)
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(transport.serverTLSConfig()))}, nil
+}
+
+// credentials are never sent in plaintext, so connections would only fail once the first call is made
+func checkAuth(transport *Transport, auth *Auth) error {
+	if auth != nil && transport.config.Insecure {
+		return fmt.Errorf("%w: authentication requires a secure transport", ErrInvalidAuthConfig)
+	}
+	return nil
+}
+
+// Dial target using transport, the default transport is used if transport is nil
+// Calls are authenticated if a default auth is set
+func Dial(target string, transport *Transport, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	transport, err := orDefault(transport)
+	if err != nil {
+		return nil, err
+	}
+	auth := DefaultAuth()
+	if err := checkAuth(transport, auth); err != nil {
+		return nil, err
+	}
+	dialOpts := []grpc.DialOption{transport.DialOption()}
+	if auth != nil {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(auth))
+	}
+	return grpc.Dial(target, append(dialOpts, opts...)...)
+}
+
+// Create a server using transport, the default transport is used if transport is nil
+// Callers are verified if a default auth is set
+func NewServer(transport *Transport, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	transport, err := orDefault(transport)
+	if err != nil {
+		return nil, err
+	}
+	auth := DefaultAuth()
+	if err := checkAuth(transport, auth); err != nil {
+		return nil, err
+	}
+	serverOpts, err := transport.ServerOptions()
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(auth.UnaryInterceptor),
+			grpc.ChainStreamInterceptor(auth.StreamInterceptor),
+		)
+	}
+	return grpc.NewServer(append(serverOpts, opts...)...), nil
+}
+
+// verifies servers against the dialed authority using the CA bundle that is current at each handshake
+type clientCredentials struct {
+	transport  *Transport
+	serverName string
+}
+
+func (creds *clientCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	_, roots := creds.transport.files.get()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the host of authority is used if empty, IP addresses are matched against the IP SANs
+		ServerName: creds.serverName,
+		// the system roots are used if no CA bundle is configured
+		RootCAs: roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := creds.transport.files.get()
+			if cert == nil {
+				// no certificate configured, the server decides whether that is acceptable
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+	return credentials.NewTLS(config).ClientHandshake(ctx, authority, rawConn)
+}
+
+func (creds *clientCredentials) ServerHandshake(net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("client credentials cannot be used by servers")
+}
+
+func (creds *clientCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: "1.2", ServerName: creds.serverName}
+}
+
+func (creds *clientCredentials) Clone() credentials.TransportCredentials {
+	return &clientCredentials{transport: creds.transport, serverName: creds.serverName}
+}
+
+func (creds *clientCredentials) OverrideServerName(serverName string) error {
+	creds.serverName = serverName
+	return nil
+}
+
+func (transport *Transport) serverTLSConfig() *tls.Config {
+	// grpc requires h2 to be negotiated, the configs per client are cloned from base so they keep it
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2"},
+	}
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, roots := transport.files.get()
+		clientConfig := base.Clone()
+		clientConfig.Certificates = []tls.Certificate{*cert}
+		clientConfig.ClientCAs = roots
+		if roots != nil {
+			clientConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		if transport.config.RequireClientCert {
+			clientConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return clientConfig, nil
+	}
+	return config
+}
+
+// holds the parsed certificate and CA bundle and reloads them if the files changed
+type fileStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+func (store *fileStore) load() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.loadLocked()
+}
+
+func (store *fileStore) loadLocked() error {
+	modTimes, err := store.statFiles()
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if store.certFile != "" {
+		loaded, err := tls.LoadX509KeyPair(store.certFile, store.keyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate: %w", err)
+		}
+		cert = &loaded
+	}
+
+	var roots *x509.CertPool
+	if store.caFile != "" {
+		pem, err := ioutil.ReadFile(store.caFile)
+		if err != nil {
+			return fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: CA bundle does not contain any certificate", ErrInvalidTransportConfig)
+		}
+	}
+
+	store.cert = cert
+	store.roots = roots
+	store.modTimes = modTimes
+	store.lastCheck = time.Now()
+	return nil
+}
+
+func (store *fileStore) statFiles() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{store.certFile, store.keyFile, store.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// returns the current certificate and CA bundle, reloading them if the files changed
+func (store *fileStore) get() (*tls.Certificate, *x509.CertPool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if time.Since(store.lastCheck) >= reloadCheckInterval {
+		store.lastCheck = time.Now()
+		if store.changed() {
+			if err := store.loadLocked(); err != nil {
+				logger.Warnw("could not reload certificates, keeping previous ones", "error", err)
+			} else {
+				logger.Info("reloaded certificates")
+			}
+		}
+	}
+	return store.cert, store.roots
+}
+
+func (store *fileStore) changed() bool {
+	modTimes, err := store.statFiles()
+	if err != nil {
+		// files are probably being replaced, try again later
+		return false
+	}
+	for file, modTime := range modTimes {
+		if !modTime.Equal(store.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
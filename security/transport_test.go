@@ -0,0 +1,248 @@
+package security
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	return key
+}
+
+var serial int64
+
+func template(commonName string) *x509.Certificate {
+	serial++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+func newAuthority(t *testing.T) *authority {
+	t.Helper()
+	key := newKey(t)
+	ca := template("test CA")
+	ca.IsCA = true
+	ca.BasicConstraintsValid = true
+	ca.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse CA: %v", err)
+	}
+	return &authority{cert: cert, key: key}
+}
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) string {
+	t.Helper()
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("could not write %s: %v", file, err)
+	}
+	return file
+}
+
+func (ca *authority) writeCA(t *testing.T, file string) string {
+	return writePEM(t, file, "CERTIFICATE", ca.cert.Raw)
+}
+
+// writes a certificate for the given names and IPs and returns the certificate and key file
+func (ca *authority) issue(t *testing.T, dir string, usage x509.ExtKeyUsage, names []string, ips ...net.IP) (string, string) {
+	t.Helper()
+	key := newKey(t)
+	cert := template("test")
+	cert.DNSNames = names
+	cert.IPAddresses = ips
+	cert.KeyUsage = x509.KeyUsageDigitalSignature
+	cert.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, cert, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("could not issue certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	name := filepath.Join(dir, cert.SerialNumber.String())
+	return writePEM(t, name+".crt", "CERTIFICATE", der), writePEM(t, name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func newTestTransport(t *testing.T, config TransportConfig) *Transport {
+	t.Helper()
+	transport, err := NewTransport(config)
+	if err != nil {
+		t.Fatalf("could not create transport: %v", err)
+	}
+	return transport
+}
+
+// serves the health service on 127.0.0.1 and returns its port
+func serve(t *testing.T, transport *Transport) string {
+	t.Helper()
+	server, err := NewServer(transport)
+	if err != nil {
+		t.Fatalf("could not create server: %v", err)
+	}
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func check(t *testing.T, target string, transport *Transport) error {
+	t.Helper()
+	conn, err := Dial(target, transport)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestServerOnlyTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caFile := ca.writeCA(t, filepath.Join(dir, "ca.crt"))
+	certFile, keyFile := ca.issue(t, dir, x509.ExtKeyUsageServerAuth, []string{"localhost"}, net.ParseIP("127.0.0.1"))
+	port := serve(t, newTestTransport(t, TransportConfig{CertFile: certFile, KeyFile: keyFile}))
+
+	client := newTestTransport(t, TransportConfig{CAFile: caFile})
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if err := check(t, net.JoinHostPort(host, port), client); err != nil {
+			t.Fatalf("could not call server at %s: %v", host, err)
+		}
+	}
+
+	// the server is not trusted without the CA bundle
+	if err := check(t, net.JoinHostPort("127.0.0.1", port), newTestTransport(t, TransportConfig{})); err == nil {
+		t.Fatal("server with an unknown CA was accepted")
+	}
+	if err := check(t, net.JoinHostPort("127.0.0.1", port), Insecure()); err == nil {
+		t.Fatal("plaintext connection to a TLS server succeeded")
+	}
+}
+
+func TestServersAreVerifiedAgainstTheDialedAuthority(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caFile := ca.writeCA(t, filepath.Join(dir, "ca.crt"))
+	certFile, keyFile := ca.issue(t, dir, x509.ExtKeyUsageServerAuth, []string{"other.example"})
+	port := serve(t, newTestTransport(t, TransportConfig{CertFile: certFile, KeyFile: keyFile}))
+
+	client := newTestTransport(t, TransportConfig{CAFile: caFile})
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if err := check(t, net.JoinHostPort(host, port), client); err == nil {
+			t.Fatalf("certificate for a different name was accepted for %s", host)
+		}
+	}
+
+	overridden := newTestTransport(t, TransportConfig{CAFile: caFile, ServerName: "other.example"})
+	if err := check(t, net.JoinHostPort("127.0.0.1", port), overridden); err != nil {
+		t.Fatalf("could not call server with overridden name: %v", err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t)
+	caFile := ca.writeCA(t, filepath.Join(dir, "ca.crt"))
+	certFile, keyFile := ca.issue(t, dir, x509.ExtKeyUsageServerAuth, []string{"localhost"})
+	port := serve(t, newTestTransport(t, TransportConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, RequireClientCert: true}))
+	target := net.JoinHostPort("localhost", port)
+
+	if err := check(t, target, newTestTransport(t, TransportConfig{CAFile: caFile})); err == nil {
+		t.Fatal("client without a certificate was accepted")
+	}
+
+	other := newAuthority(t)
+	otherCert, otherKey := other.issue(t, dir, x509.ExtKeyUsageClientAuth, []string{"client"})
+	if err := check(t, target, newTestTransport(t, TransportConfig{CertFile: otherCert, KeyFile: otherKey, CAFile: caFile})); err == nil {
+		t.Fatal("client certificate of an unknown CA was accepted")
+	}
+
+	clientCert, clientKey := ca.issue(t, dir, x509.ExtKeyUsageClientAuth, []string{"client"})
+	if err := check(t, target, newTestTransport(t, TransportConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile})); err != nil {
+		t.Fatalf("could not call server with a client certificate: %v", err)
+	}
+}
+
+func TestRotatedCABundleIsPickedUp(t *testing.T) {
+	dir := t.TempDir()
+	oldCA := newAuthority(t)
+	newCA := newAuthority(t)
+	caFile := oldCA.writeCA(t, filepath.Join(dir, "ca.crt"))
+	certFile, keyFile := newCA.issue(t, dir, x509.ExtKeyUsageServerAuth, []string{"localhost"})
+	port := serve(t, newTestTransport(t, TransportConfig{CertFile: certFile, KeyFile: keyFile}))
+	target := net.JoinHostPort("localhost", port)
+
+	client := newTestTransport(t, TransportConfig{CAFile: caFile})
+	if err := check(t, target, client); err == nil {
+		t.Fatal("server with an untrusted CA was accepted")
+	}
+
+	newCA.writeCA(t, caFile)
+	// make sure the modification time changes even on filesystems with a coarse resolution
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, modTime, modTime); err != nil {
+		t.Fatalf("could not touch CA bundle: %v", err)
+	}
+	_, roots := client.files.get()
+	if _, err := newCA.cert.Verify(x509.VerifyOptions{Roots: roots}); err == nil {
+		t.Fatal("CA bundle was reloaded before the check interval elapsed")
+	}
+
+	client.files.mutex.Lock()
+	client.files.lastCheck = time.Now().Add(-reloadCheckInterval)
+	client.files.mutex.Unlock()
+	if err := check(t, target, client); err != nil {
+		t.Fatalf("rotated CA bundle was not picked up: %v", err)
+	}
+}
+
+func TestDefaultTransportHasToBeConfigured(t *testing.T) {
+	if _, err := Dial("localhost:1", nil); !errors.Is(err, ErrTransportNotConfigured) {
+		t.Fatalf("expected ErrTransportNotConfigured, got %v", err)
+	}
+	if _, err := NewServer(nil); !errors.Is(err, ErrTransportNotConfigured) {
+		t.Fatalf("expected ErrTransportNotConfigured, got %v", err)
+	}
+}